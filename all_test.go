@@ -9,11 +9,16 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"math/rand"
 	"path"
 	"runtime"
 	"runtime/debug"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/cznic/mathutil"
 	"github.com/cznic/strutil"
@@ -140,6 +145,107 @@ func (t *Tree) dump() string {
 	return s
 }
 
+// verify checks the structural invariants of t.
+func (t *Tree) verify() error {
+	if t.r == nil {
+		if t.c != 0 || t.first != nil || t.last != nil || t.nd != 0 || t.nx != 0 {
+			return fmt.Errorf("empty tree: c %d, first %p, last %p, nd %d, nx %d", t.c, t.first, t.last, t.nd, t.nx)
+		}
+
+		return nil
+	}
+
+	var leaves []*d
+	xs := 0
+	depth := -1
+	var f func(q interface{}, lo, hi interface{}, level int) error
+	f = func(q interface{}, lo, hi interface{}, level int) error {
+		switch x := q.(type) {
+		case *x:
+			if x.c < 1 || x.c > 2*kx+1 || q != t.r && x.c < kx-1 {
+				return fmt.Errorf("x page %p: c %d", x, x.c)
+			}
+
+			xs++
+
+			for i := 0; i <= x.c; i++ {
+				l, h := lo, hi
+				if i > 0 {
+					l = x.x[i-1].k
+				}
+				if i < x.c {
+					h = x.x[i].k
+				}
+				if l != nil && h != nil && t.cmp(l, h) >= 0 {
+					return fmt.Errorf("x page %p: separators out of order", x)
+				}
+
+				if err := f(x.x[i].ch, l, h, level+1); err != nil {
+					return err
+				}
+			}
+		case *d:
+			if x.c < 1 || x.c > 2*kd || q != t.r && x.c < kd {
+				return fmt.Errorf("d page %p: c %d", x, x.c)
+			}
+
+			if depth < 0 {
+				depth = level
+			}
+			if level != depth {
+				return fmt.Errorf("d page %p: depth %d, expected %d", x, level, depth)
+			}
+
+			if !t.compress && x.pfx != "" {
+				return fmt.Errorf("d page %p: prefix %q", x, x.pfx)
+			}
+
+			for i := 0; i < x.c; i++ {
+				k := t.key(x, i)
+				if i > 0 && t.cmp(t.key(x, i-1), k) >= 0 ||
+					lo != nil && t.cmp(k, lo) < 0 ||
+					hi != nil && t.cmp(k, hi) >= 0 {
+					return fmt.Errorf("d page %p: key %v out of order", x, k)
+				}
+			}
+			leaves = append(leaves, x)
+		}
+		return nil
+	}
+	if err := f(t.r, nil, nil, 0); err != nil {
+		return err
+	}
+
+	n := 0
+	for i, q := range leaves {
+		var p, nx *d
+		if i > 0 {
+			p = leaves[i-1]
+		}
+		if i+1 < len(leaves) {
+			nx = leaves[i+1]
+		}
+		if q.p != p || q.n != nx {
+			return fmt.Errorf("d page %p: bad links", q)
+		}
+
+		n += q.c
+	}
+	if t.first != leaves[0] || t.last != leaves[len(leaves)-1] {
+		return fmt.Errorf("bad first or last page")
+	}
+
+	if n != t.c {
+		return fmt.Errorf("c %d, expected %d", t.c, n)
+	}
+
+	if len(leaves) != t.nd || xs != t.nx {
+		return fmt.Errorf("nd %d, nx %d, expected %d, %d", t.nd, t.nx, len(leaves), xs)
+	}
+
+	return nil
+}
+
 func rng() *mathutil.FC32 {
 	x, err := mathutil.NewFC32(math.MinInt32/4, math.MaxInt32/4, false)
 	if err != nil {
@@ -150,7 +256,7 @@ func rng() *mathutil.FC32 {
 }
 
 func cmp(a, b interface{}) int {
-	return a.(int) - b.(int)
+	return Ints(a, b)
 }
 
 func TestGet0(t *testing.T) {
@@ -1008,6 +1114,42 @@ func benchmarkSeekSeq(b *testing.B, n int) {
 	b.StopTimer()
 }
 
+func BenchmarkSeekFromSeq1e3(b *testing.B) {
+	benchmarkSeekFromSeq(b, 1e3)
+}
+
+func BenchmarkSeekFromSeq1e4(b *testing.B) {
+	benchmarkSeekFromSeq(b, 1e4)
+}
+
+func BenchmarkSeekFromSeq1e5(b *testing.B) {
+	benchmarkSeekFromSeq(b, 1e5)
+}
+
+func BenchmarkSeekFromSeq1e6(b *testing.B) {
+	benchmarkSeekFromSeq(b, 1e6)
+}
+
+func benchmarkSeekFromSeq(b *testing.B, n int) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		t := TreeNew(cmp)
+		for j := 0; j < n; j++ {
+			t.Set(j, 0)
+		}
+		debug.FreeOSMemory()
+		b.StartTimer()
+		e, _ := t.SeekFirst()
+		for j := 0; j < n; j++ {
+			e.SeekFrom(j)
+		}
+		e.Close()
+		b.StopTimer()
+		t.Close()
+	}
+	b.StopTimer()
+}
+
 func BenchmarkSeekRnd1e3(b *testing.B) {
 	benchmarkSeekRnd(b, 1e3)
 }
@@ -1461,3 +1603,2779 @@ func TestPR4(t *testing.T) {
 		t.Fatalf("key lost: %v", k)
 	}
 }
+
+func TestTreeNewBytes(t *testing.T) {
+	const N = 1 << 14
+	rng := rng()
+	tr := TreeNewBytes()
+	m := map[string]int{}
+	for i := 0; i < N; i++ {
+		k := []byte(fmt.Sprintf("%x", rng.Next()))
+		tr.Set(k, i)
+		m[string(k)] = i
+	}
+	if g, e := tr.Len(), len(m); g != e {
+		t.Fatal(g, e)
+	}
+
+	for k, v := range m {
+		g, ok := tr.Get([]byte(k))
+		if !ok || g != v {
+			t.Fatal(k, g, ok, v)
+		}
+
+		if _, ok := tr.Get([]byte(k + "\x00")); ok {
+			t.Fatal(k)
+		}
+	}
+
+	en, err := tr.SeekFirst()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var prev []byte
+	n := 0
+	for {
+		k, _, err := en.Next()
+		if err != nil {
+			if err != io.EOF {
+				t.Fatal(err)
+			}
+
+			break
+		}
+
+		if n != 0 && bytes.Compare(prev, k.([]byte)) >= 0 {
+			t.Fatalf("%q %q", prev, k)
+		}
+
+		prev = k.([]byte)
+		n++
+	}
+	if g, e := n, len(m); g != e {
+		t.Fatal(g, e)
+	}
+
+	for k := range m {
+		if !tr.Delete([]byte(k)) {
+			t.Fatal(k)
+		}
+	}
+	if g, e := tr.Len(), 0; g != e {
+		t.Fatal(g, e)
+	}
+}
+
+func TestTreeNewString(t *testing.T) {
+	tr := TreeNewString()
+	for i := 0; i < 1000; i++ {
+		tr.Set(fmt.Sprint(i), i)
+	}
+	for i := 0; i < 1000; i++ {
+		if v, ok := tr.Get(fmt.Sprint(i)); !ok || v != i {
+			t.Fatal(i, v, ok)
+		}
+	}
+	if k, _ := tr.First(); k != "0" {
+		t.Fatal(k)
+	}
+
+	if k, _ := tr.Last(); k != "999" {
+		t.Fatal(k)
+	}
+}
+
+func TestPrefixCompression(t *testing.T) {
+	const pfx = "/usr/share/doc/"
+	tab := []struct {
+		tr  *Tree
+		key func(s string) interface{}
+	}{
+		{TreeNewBytes(), func(s string) interface{} { return []byte(s) }},
+		{TreeNewString(), func(s string) interface{} { return s }},
+	}
+	for _, test := range tab {
+		rng := rand.New(rand.NewSource(42))
+		tr, key := test.tr, test.key
+		m := map[string]int{}
+		sorted := func() (a []string) {
+			for k := range m {
+				a = append(a, k)
+			}
+			sort.Strings(a)
+			return a
+		}
+		check := func() {
+			if err := tr.verify(); err != nil {
+				t.Fatal(err)
+			}
+
+			var e, g, r []string
+			for _, k := range sorted() {
+				e = append(e, fmt.Sprintf("%s:%d", k, m[k]))
+			}
+			en, err := tr.SeekFirst()
+			for err == nil {
+				var k, v interface{}
+				if k, v, err = en.Next(); err == nil {
+					g = append(g, fmt.Sprintf("%s:%d", k, v))
+				}
+			}
+			en, err = tr.SeekLast()
+			for err == nil {
+				var k, v interface{}
+				if k, v, err = en.Prev(); err == nil {
+					r = append([]string{fmt.Sprintf("%s:%d", k, v)}, r...)
+				}
+			}
+			if g, e := fmt.Sprint(g), fmt.Sprint(e); g != e {
+				t.Fatalf("\n%s\n%s", g, e)
+			}
+
+			if g, e := fmt.Sprint(r), fmt.Sprint(e); g != e {
+				t.Fatalf("\n%s\n%s", g, e)
+			}
+		}
+		rndKey := func() string { return fmt.Sprintf("%s%03d/%d", pfx, rng.Intn(100), rng.Intn(1000)) }
+
+		for i := 0; i < 3000; i++ {
+			k := rndKey()
+			tr.Set(key(k), i)
+			m[k] = i
+		}
+		check()
+		for q := tr.first; q != nil; q = q.n {
+			if !strings.HasPrefix(q.pfx, pfx) {
+				t.Fatalf("%q", q.pfx)
+			}
+		}
+
+		a := sorted()
+		for _, k := range append(a[:100:100], "", "/a", pfx, pfx+"050/", pfx+"050/5000", "/usr/share/e", "\xff") {
+			v, ok := tr.Get(key(k))
+			if ev, eok := m[k]; v != nil && v != ev || ok != eok {
+				t.Fatal(k, v, ok, ev, eok)
+			}
+
+			en, _ := tr.Seek(key(k))
+			gk, _, err := en.Next()
+			switch i := sort.SearchStrings(a, k); {
+			case i == len(a):
+				if err != io.EOF {
+					t.Fatal(k, gk, err)
+				}
+			default:
+				if err != nil || fmt.Sprintf("%s", gk) != a[i] {
+					t.Fatal(k, gk, err, a[i])
+				}
+			}
+		}
+
+		for i, k := range a {
+			if i%3 != 0 {
+				tr.Delete(key(k))
+				delete(m, k)
+			}
+		}
+		check()
+		for i := 0; i < 1000; i++ {
+			k := rndKey()
+			tr.Put(key(k), func(interface{}, bool) (interface{}, bool) { return i, true })
+			m[k] = i
+		}
+		check()
+		tr.DeleteFunc(func(k, v interface{}) bool { return v.(int)%2 != 0 })
+		for k, v := range m {
+			if v%2 != 0 {
+				delete(m, k)
+			}
+		}
+		check()
+		var items []Item
+		for i := 0; i < 500; i++ {
+			k := rndKey()
+			items = append(items, Item{key(k), i})
+			m[k] = i
+		}
+		tr.BuildParallel(items, 4)
+		check()
+		keys, _ := tr.PopFirstN(100)
+		for i, k := range sorted()[:100] {
+			if g := fmt.Sprintf("%s", keys[i]); g != k {
+				t.Fatal(i, g, k)
+			}
+
+			delete(m, k)
+		}
+		check()
+		for _, k := range []string{"", "/a", "\xff"} {
+			tr.Set(key(k), -1)
+			m[k] = -1
+		}
+		check()
+		if !tr.Equal(tr.Clone(nil), nil) {
+			t.Fatal("clone differs")
+		}
+	}
+}
+
+func TestSeekPrefix(t *testing.T) {
+	keys := []string{"", "a", "ab", "abc", "abd", "ab\xff", "ab\xff\xff", "b", "\xff", "\xff\xff"}
+	tab := []struct {
+		p    string
+		keys []string
+	}{
+		{"", keys},
+		{"a", []string{"a", "ab", "abc", "abd", "ab\xff", "ab\xff\xff"}},
+		{"ab", []string{"ab", "abc", "abd", "ab\xff", "ab\xff\xff"}},
+		{"ab\xff", []string{"ab\xff", "ab\xff\xff"}},
+		{"abc", []string{"abc"}},
+		{"abe", nil},
+		{"b", []string{"b"}},
+		{"c", nil},
+		{"\xff", []string{"\xff", "\xff\xff"}},
+		{"\xff\xff\xff", nil},
+	}
+
+	bt, st := TreeNewBytes(), TreeNewString()
+	for _, k := range keys {
+		bt.Set([]byte(k), k)
+		st.Set(k, k)
+	}
+	for i, test := range tab {
+		for _, p := range []interface{}{[]byte(test.p), test.p} {
+			tr := st
+			if _, ok := p.([]byte); ok {
+				tr = bt
+			}
+
+			en, err := tr.SeekPrefix(p)
+			if len(test.keys) == 0 {
+				if err != io.EOF {
+					t.Fatal(i, err)
+				}
+
+				continue
+			}
+
+			if err != nil {
+				t.Fatal(i, err)
+			}
+
+			var g []string
+			for {
+				_, v, err := en.Next()
+				if err != nil {
+					if err != io.EOF {
+						t.Fatal(i, err)
+					}
+
+					break
+				}
+
+				g = append(g, v.(string))
+			}
+			if g, e := fmt.Sprintf("%q", g), fmt.Sprintf("%q", test.keys); g != e {
+				t.Fatal(i, g, e)
+			}
+
+			en, _ = tr.SeekPrefix(p)
+			if _, v, err := en.Prev(); err != nil || v != test.keys[0] {
+				t.Fatal(i, v, err)
+			}
+
+			if _, _, err := en.Prev(); err != io.EOF {
+				t.Fatal(i, err)
+			}
+		}
+	}
+
+	if _, err := TreeNew(cmp).SeekPrefix(42); err == nil || err == io.EOF {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkSetRndBytes1e5(b *testing.B) {
+	a := make([][]byte, 1e5)
+	rng := rng()
+	for i := range a {
+		a[i] = []byte(fmt.Sprintf("%x", rng.Next()))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := TreeNewBytes()
+		for _, k := range a {
+			r.Set(k, nil)
+		}
+		b.StopTimer()
+		r.Close()
+		b.StartTimer()
+	}
+}
+
+func TestScanPrefix(t *testing.T) {
+	paths := []string{"/", "/etc", "/etc/hosts", "/usr", "/usr/", "/usr/bin", "/usr/bin/go", "/usr/lib", "/usr0", "/var"}
+	tr := TreeNewOptions(func(a, b interface{}) int { return strings.Compare(a.(string), b.(string)) }, &Options{
+		PrefixSuccessor: func(p interface{}) (interface{}, bool) {
+			s := p.(string)
+			return s[:len(s)-1] + string(s[len(s)-1]+1), true
+		},
+	})
+	for _, p := range paths {
+		tr.Set(p, nil)
+	}
+
+	tab := []struct {
+		p, keys string
+		max     int
+	}{
+		{"/usr/", "/usr/ /usr/bin /usr/bin/go /usr/lib", -1},
+		{"/usr/", "/usr/ /usr/bin", 2},
+		{"/usr/bin", "/usr/bin /usr/bin/go", -1},
+		{"/usr/bin/", "/usr/bin/go", -1},
+		{"/etc/", "/etc/hosts", -1},
+		{"/opt/", "", -1},
+		{"/v", "/var", -1},
+	}
+	for i, test := range tab {
+		var a []string
+		if err := tr.ScanPrefix(test.p, func(k, v interface{}) bool {
+			a = append(a, k.(string))
+			return len(a) != test.max
+		}); err != nil {
+			t.Fatal(i, err)
+		}
+
+		if g, e := strings.Join(a, " "), test.keys; g != e {
+			t.Fatalf("%d: %q %q", i, g, e)
+		}
+	}
+
+	if err := TreeNew(cmp).ScanPrefix(42, nil); err == nil {
+		t.Fatal(err)
+	}
+}
+
+var sumMonoid = &Monoid{
+	Zero:     0,
+	FromItem: func(k, v interface{}) interface{} { return v },
+	Combine:  func(a, b interface{}) interface{} { return a.(int) + b.(int) },
+}
+
+// checkAggregates verifies the aggregate of every page of t.
+func checkAggregates(t *Tree) error {
+	var f func(q interface{}) (int, error)
+	f = func(q interface{}) (s int, err error) {
+		switch x := q.(type) {
+		case *x:
+			for i := 0; i <= x.c; i++ {
+				n, err := f(x.x[i].ch)
+				if err != nil {
+					return 0, err
+				}
+
+				s += n
+			}
+			if g, e := x.a.(int), s; g != e {
+				return 0, fmt.Errorf("x page %p: aggregate %v, expected %v", x, g, e)
+			}
+		case *d:
+			for i := 0; i < x.c; i++ {
+				s += x.d[i].v.(int)
+			}
+			if g, e := x.a.(int), s; g != e {
+				return 0, fmt.Errorf("d page %p: aggregate %v, expected %v", x, g, e)
+			}
+		}
+		return s, nil
+	}
+	_, err := f(t.r)
+	return err
+}
+
+func TestAggregate(t *testing.T) {
+	const N = 1 << 14
+	rng := rand.New(rand.NewSource(42))
+	tr := TreeNewOptions(cmp, &Options{Monoid: sumMonoid})
+	a := make([]int, 2*N)
+	sum := func(lo, hi int) (s int) {
+		for i := lo; i < hi; i++ {
+			s += a[i]
+		}
+		return s
+	}
+	check := func() {
+		if err := checkAggregates(tr); err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := tr.AggregateAll(), sum(0, len(a)); g != e {
+			t.Fatal(g, e)
+		}
+
+		for i := 0; i < 100; i++ {
+			lo, hi := rng.Intn(len(a)), rng.Intn(len(a))
+			if g, e := tr.Aggregate(lo, hi), sum(lo, hi); g != e {
+				t.Fatal(lo, hi, g, e)
+			}
+		}
+	}
+
+	for i := 0; i < N; i++ {
+		k := rng.Intn(len(a))
+		a[k] = k + 1
+		tr.Set(k, k+1)
+		if i%1000 == 0 {
+			check()
+		}
+	}
+	check()
+	for i := 0; i < N; i++ {
+		k := rng.Intn(len(a))
+		a[k] = 2 * k
+		tr.Put(k, func(interface{}, bool) (interface{}, bool) { return 2 * k, true })
+	}
+	check()
+	for i := 0; i < 4*N; i++ {
+		k := rng.Intn(len(a))
+		a[k] = 0
+		tr.Delete(k)
+		if i%1000 == 0 {
+			check()
+		}
+	}
+	check()
+	for k := range a {
+		a[k] = 0
+		tr.Delete(k)
+	}
+	check()
+	if g, e := tr.Len(), 0; g != e {
+		t.Fatal(g, e)
+	}
+}
+
+func TestIntervalTree(t *testing.T) {
+	const N = 1 << 12
+	rng := rand.New(rand.NewSource(42))
+	tr := IntervalTreeNew(cmp)
+	m := map[Interval]int{}
+	for i := 0; i < N; i++ {
+		lo := rng.Intn(10 * N)
+		iv := Interval{lo, lo + 1 + rng.Intn(1+rng.Intn(N))}
+		tr.Set(iv, i)
+		m[iv] = i
+	}
+	for i := 0; i < N/4; i++ {
+		lo := rng.Intn(10 * N)
+		iv := Interval{lo, lo + 1 + rng.Intn(1+rng.Intn(N))}
+		if _, ok := m[iv]; ok {
+			continue
+		}
+
+		tr.Set(iv, -1)
+		tr.Delete(iv)
+	}
+	if g, e := tr.Len(), len(m); g != e {
+		t.Fatal(g, e)
+	}
+
+	collect := func(en *IntervalEnumerator) (a []Interval) {
+		for {
+			iv, v, err := en.Next()
+			if err != nil {
+				if err != io.EOF {
+					t.Fatal(err)
+				}
+
+				return a
+			}
+
+			if g, e := v, m[iv]; g != e {
+				t.Fatal(iv, g, e)
+			}
+
+			a = append(a, iv)
+		}
+	}
+	brute := func(f func(Interval) bool) (a []Interval) {
+		for iv := range m {
+			if f(iv) {
+				a = append(a, iv)
+			}
+		}
+		return a
+	}
+	same := func(g, e []Interval) bool {
+		if len(g) != len(e) {
+			return false
+		}
+
+		set := map[Interval]bool{}
+		for _, iv := range e {
+			set[iv] = true
+		}
+		for i, iv := range g {
+			if !set[iv] || i != 0 && tr.t.cmp(g[i-1], iv) >= 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	for i := 0; i < 200; i++ {
+		p := rng.Intn(11 * N)
+		g := collect(tr.Stabbing(p))
+		e := brute(func(iv Interval) bool { return iv.Lo.(int) <= p && p < iv.Hi.(int) })
+		if !same(g, e) {
+			t.Fatal(p, len(g), len(e))
+		}
+
+		lo := rng.Intn(11 * N)
+		hi := lo + rng.Intn(N)
+		g = collect(tr.Overlapping(lo, hi))
+		e = brute(func(iv Interval) bool { return lo < hi && iv.Lo.(int) < hi && iv.Hi.(int) > lo })
+		if !same(g, e) {
+			t.Fatal(lo, hi, len(g), len(e))
+		}
+	}
+
+	// Mutating the tree while enumerating.
+	p := 5 * N
+	e := brute(func(iv Interval) bool { return iv.Lo.(int) <= p && p < iv.Hi.(int) })
+	en := tr.Stabbing(p)
+	var g []Interval
+	for i := 0; ; i++ {
+		iv, _, err := en.Next()
+		if err != nil {
+			break
+		}
+
+		g = append(g, iv)
+		for j := 0; j < 10; j++ {
+			if lo := rng.Intn(10 * N); lo != p {
+				tr.Set(Interval{lo, lo + 1}, nil)
+			}
+		}
+	}
+	if !same(g, e) {
+		t.Fatal(len(g), len(e))
+	}
+}
+
+func TestIntervalTreeEmpty(t *testing.T) {
+	tr := IntervalTreeNew(cmp)
+	for _, iv := range []Interval{{5, 3}, {6, 6}, {2, 7}, {8, 12}, {10, 10}, {12, 20}} {
+		tr.Set(iv, nil)
+	}
+	collect := func(en *IntervalEnumerator) string {
+		var a []Interval
+		for {
+			iv, _, err := en.Next()
+			if err != nil {
+				return fmt.Sprint(a)
+			}
+
+			a = append(a, iv)
+		}
+	}
+	if g, e := collect(tr.Overlapping(0, 10)), "[{2 7} {8 12}]"; g != e {
+		t.Fatal(g, e)
+	}
+
+	if g, e := collect(tr.Stabbing(6)), "[{2 7}]"; g != e {
+		t.Fatal(g, e)
+	}
+
+	if g, e := collect(tr.Stabbing(10)), "[{8 12}]"; g != e {
+		t.Fatal(g, e)
+	}
+
+	for _, r := range [][2]int{{5, 3}, {6, 6}, {10, 0}} {
+		if g, e := collect(tr.Overlapping(r[0], r[1])), "[]"; g != e {
+			t.Fatal(r, g, e)
+		}
+	}
+}
+
+func TestNearest(t *testing.T) {
+	const N = 1 << 12
+	tr := TreeNew(cmp)
+	if _, _, ok := tr.Floor(42); ok {
+		t.Fatal(ok)
+	}
+
+	for i := 0; i < N; i++ {
+		tr.Set(2*i+1, -(2*i + 1))
+	}
+	has := func(k int) bool { return k&1 != 0 && k > 0 && k < 2*N }
+	for k := -2; k <= 2*N+1; k++ {
+		ceil, floor, higher, lower := k, k, k+1, k-1
+		for ; ceil <= 2*N && !has(ceil); ceil++ {
+		}
+		for ; floor >= 0 && !has(floor); floor-- {
+		}
+		for ; higher <= 2*N && !has(higher); higher++ {
+		}
+		for ; lower >= 0 && !has(lower); lower-- {
+		}
+		for i, test := range []struct {
+			f    func(interface{}) (interface{}, interface{}, bool)
+			want int
+		}{
+			{tr.Ceiling, ceil},
+			{tr.Floor, floor},
+			{tr.Higher, higher},
+			{tr.Lower, lower},
+		} {
+			g, v, ok := test.f(k)
+			if !has(test.want) {
+				if ok {
+					t.Fatal(k, i, g)
+				}
+
+				continue
+			}
+
+			if !ok || g != test.want || v != -test.want {
+				t.Fatal(k, i, g, v, ok, test.want)
+			}
+		}
+	}
+}
+
+func TestPop(t *testing.T) {
+	const N = 1 << 14
+	rng := rand.New(rand.NewSource(42))
+	tr := TreeNewOptions(cmp, &Options{Monoid: sumMonoid})
+	if _, _, ok := tr.PopFirst(); ok {
+		t.Fatal(ok)
+	}
+
+	for _, i := range rng.Perm(N) {
+		tr.Set(i, i)
+	}
+	lo, hi := 0, N-1
+	for tr.Len() != 0 {
+		var k, v interface{}
+		var ok bool
+		switch rng.Intn(2) {
+		case 0:
+			if k, v, ok = tr.PopFirst(); !ok || k != lo || v != lo {
+				t.Fatal(k, v, ok, lo)
+			}
+
+			lo++
+		default:
+			if k, v, ok = tr.PopLast(); !ok || k != hi || v != hi {
+				t.Fatal(k, v, ok, hi)
+			}
+
+			hi--
+		}
+		if lo%1000 == 0 {
+			if err := tr.verify(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := checkAggregates(tr); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if g, e := lo, hi+1; g != e {
+		t.Fatal(g, e)
+	}
+
+	if err := tr.verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPopFirstN(t *testing.T) {
+	const N = 1 << 14
+	rng := rand.New(rand.NewSource(42))
+	tr := TreeNewOptions(cmp, &Options{Monoid: sumMonoid})
+	for _, i := range rng.Perm(N) {
+		tr.Set(i, i)
+	}
+	next := 0
+	for tr.Len() != 0 {
+		n := rng.Intn(200)
+		keys, values := tr.PopFirstN(n)
+		if len(keys) != n && tr.Len() != 0 {
+			t.Fatal(len(keys), n)
+		}
+
+		for i, k := range keys {
+			if k != next || values[i] != next {
+				t.Fatal(k, values[i], next)
+			}
+
+			next++
+		}
+		if err := tr.verify(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := checkAggregates(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if g, e := next, N; g != e {
+		t.Fatal(g, e)
+	}
+}
+
+func TestEnumeratorResync(t *testing.T) {
+	tr := TreeNew(cmp)
+	for i := 0; i < 1000; i++ {
+		tr.Set(2*i, nil)
+	}
+	en, _ := tr.Seek(500)
+	for i := 500; i < 2000; i += 2 {
+		k, _, err := en.Next()
+		if err != nil || k != i {
+			t.Fatal(k, err, i)
+		}
+
+		tr.Set(k.(int)+1, nil) // mutates the tree
+		tr.Delete(k.(int) + 1)
+	}
+	if _, _, err := en.Next(); err != io.EOF {
+		t.Fatal(err)
+	}
+
+	en, _ = tr.Seek(500)
+	for i := 500; i >= 0; i -= 2 {
+		k, _, err := en.Prev()
+		if err != nil || k != i {
+			t.Fatal(k, err, i)
+		}
+
+		tr.Set(k.(int)-1, nil)
+		tr.Delete(k.(int) - 1)
+	}
+	if _, _, err := en.Prev(); err != io.EOF {
+		t.Fatal(err)
+	}
+}
+
+func TestEnumeratorDelete(t *testing.T) {
+	const N = 1 << 14
+	for _, prev := range []bool{false, true} {
+		tr := TreeNewOptions(cmp, &Options{Monoid: sumMonoid})
+		for i := 0; i < N; i++ {
+			tr.Set(i, i)
+		}
+		en, err := tr.SeekFirst()
+		if prev {
+			en, err = tr.SeekLast()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if en.Delete() {
+			t.Fatal("deleted before Next")
+		}
+
+		n := 0
+		for {
+			f := en.Next
+			if prev {
+				f = en.Prev
+			}
+			k, _, err := f()
+			if err != nil {
+				break
+			}
+
+			n++
+			switch k.(int) % 3 {
+			case 0:
+				if !en.Delete() {
+					t.Fatal(k)
+				}
+
+				if en.Delete() {
+					t.Fatal(k)
+				}
+			case 1:
+				if !en.SetValue(-k.(int)) {
+					t.Fatal(k)
+				}
+			}
+		}
+		if n != N {
+			t.Fatal(prev, n, N)
+		}
+
+		if err := tr.verify(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := checkAggregates(tr); err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := tr.Len(), N-(N+2)/3; g != e {
+			t.Fatal(g, e)
+		}
+
+		for i := 0; i < N; i++ {
+			v, ok := tr.Get(i)
+			switch i % 3 {
+			case 0:
+				if ok {
+					t.Fatal(i)
+				}
+			case 1:
+				if !ok || v != -i {
+					t.Fatal(i, v, ok)
+				}
+			case 2:
+				if !ok || v != i {
+					t.Fatal(i, v, ok)
+				}
+			}
+		}
+
+		// Purge everything.
+		en, _ = tr.SeekFirst()
+		for {
+			if _, _, err := en.Next(); err != nil {
+				break
+			}
+
+			en.Delete()
+		}
+		if err := tr.verify(); err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := tr.Len(), 0; g != e {
+			t.Fatal(g, e)
+		}
+	}
+}
+
+func TestEnumeratorStrict(t *testing.T) {
+	const N = 1 << 12
+	tr := TreeNew(cmp)
+	for i := 0; i < N; i++ {
+		tr.Set(i, i)
+	}
+	en, _ := tr.SeekFirst()
+	en.SetMode(Strict)
+	for i := 0; i < N; i++ {
+		k, _, err := en.Next()
+		if err != nil || k != i {
+			t.Fatal(i, k, err)
+		}
+
+		switch {
+		case i%2 == 0:
+			if !en.Delete() { // both the fast and the slow path
+				t.Fatal(i)
+			}
+		default:
+			if !en.SetValue(-i) { // an own mutation
+				t.Fatal(i)
+			}
+		}
+	}
+	if _, _, err := en.Next(); err != io.EOF {
+		t.Fatal(err)
+	}
+
+	if err := tr.verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, prev := range []bool{false, true} {
+		en, _ = tr.Seek(N / 2)
+		en.SetMode(Strict)
+		f := en.Next
+		if prev {
+			f = en.Prev
+		}
+		if _, _, err := f(); err != nil {
+			t.Fatal(err)
+		}
+
+		tr.Set(-1, nil)
+		tr.Delete(-1)
+		for i := 0; i < 2; i++ {
+			if _, _, err := f(); err != ErrConcurrentModification {
+				t.Fatal(prev, err)
+			}
+		}
+	}
+
+	// Setting the value of an existing key is a concurrent mutation.
+	for _, f := range []func(){
+		func() { tr.Set(5, "changed by someone else") },
+		func() { tr.Put(5, func(interface{}, bool) (interface{}, bool) { return 42, true }) },
+		func() { tr.CompareAndSwap(5, -5, 42, nil) },
+	} {
+		tr.Set(5, -5)
+		en, _ = tr.Seek(1)
+		en.SetMode(Strict)
+		en.Next()
+		f()
+		if _, _, err := en.Next(); err != ErrConcurrentModification {
+			t.Fatal(err)
+		}
+	}
+
+	// A mutation before setting the mode is not a concurrent one.
+	en, _ = tr.Seek(1)
+	en.Next()
+	tr.Delete(3)
+	tr.Set(5, -5)
+	en.SetMode(Strict)
+	if k, _, err := en.Next(); err != nil || k != 5 {
+		t.Fatal(k, err)
+	}
+}
+
+func TestEnumeratorSnapshot(t *testing.T) {
+	const N = 1 << 12
+	tr := TreeNew(cmp)
+	for i := 0; i < N; i++ {
+		tr.Set(i, i)
+	}
+	for _, prev := range []bool{false, true} {
+		en, _ := tr.SeekFirst()
+		want := 0
+		f := en.Next
+		if prev {
+			en, _ = tr.SeekLast()
+			want = N - 1
+			f = en.Prev
+		}
+		en.SetMode(Snapshot)
+		for i := 0; i < N; i++ {
+			k, v, err := f()
+			if err != nil || k != want || v != want {
+				t.Fatal(i, k, v, err, want)
+			}
+
+			switch i % 3 {
+			case 0:
+				tr.Delete(k)
+			case 1:
+				en.Delete()
+			}
+			tr.Set(N+i, nil)
+			if prev {
+				want--
+				continue
+			}
+
+			want++
+		}
+		if _, _, err := f(); err != io.EOF {
+			t.Fatal(err)
+		}
+
+		en.Close()
+		if g, e := tr.Len(), N/3+N; g != e {
+			t.Fatal(g, e)
+		}
+
+		tr.Clear()
+		for i := 0; i < N; i++ {
+			tr.Set(i, i)
+		}
+	}
+
+	// Leaving the snapshot mode resyncs with the tree.
+	en, _ := tr.SeekFirst()
+	en.SetMode(Snapshot)
+	en.Next()
+	tr.Delete(1)
+	if k, _, _ := en.Next(); k != 1 {
+		t.Fatal(k)
+	}
+
+	en.SetMode(Resync)
+	if k, _, _ := en.Next(); k != 2 {
+		t.Fatal(k)
+	}
+}
+
+func TestCursor(t *testing.T) {
+	const N = 1 << 12
+	tr := TreeNew(cmp)
+	c := tr.Cursor()
+	if c.Valid() || c.Next() || c.First() || c.Last() || c.Seek(0) || c.SeekForPrev(0) {
+		t.Fatal("valid cursor of an empty tree")
+	}
+
+	for i := 0; i < N; i++ {
+		tr.Set(2*i, i)
+	}
+	n := 0
+	for ok := c.First(); ok; ok = c.Next() {
+		if g, e := c.Key(), 2*n; g != e {
+			t.Fatal(g, e)
+		}
+
+		if g, e := c.Value(), n; g != e {
+			t.Fatal(g, e)
+		}
+
+		n++
+	}
+	if n != N || c.Valid() || c.Key() != nil || c.Err() != nil {
+		t.Fatal(n, c.Valid(), c.Key(), c.Err())
+	}
+
+	n = N
+	for ok := c.Last(); ok; ok = c.Prev() {
+		n--
+		if g, e := c.Key(), 2*n; g != e {
+			t.Fatal(g, e)
+		}
+	}
+	if n != 0 {
+		t.Fatal(n)
+	}
+
+	for k := -1; k <= 2*N; k++ {
+		ok := c.Seek(k)
+		if e := (k + 1) &^ 1; e < 2*N {
+			if !ok || c.Key() != e {
+				t.Fatal(k, ok, c.Key(), e)
+			}
+		} else if ok {
+			t.Fatal(k, c.Key())
+		}
+
+		ok = c.SeekForPrev(k)
+		if e := mathutil.Min(k&^1, 2*N-2); k >= 0 {
+			if !ok || c.Key() != e {
+				t.Fatal(k, ok, c.Key(), e)
+			}
+		} else if ok {
+			t.Fatal(k, c.Key())
+		}
+	}
+
+	// Switching directions.
+	c.Seek(100)
+	if !c.Next() || c.Key() != 102 || !c.Prev() || c.Key() != 100 || !c.Prev() || c.Key() != 98 {
+		t.Fatal(c.Key())
+	}
+
+	// The current item is removed.
+	c.Seek(100)
+	tr.Delete(100)
+	if c.Valid() || c.Key() != nil {
+		t.Fatal(c.Key())
+	}
+
+	if !c.Next() || c.Key() != 102 {
+		t.Fatal(c.Key())
+	}
+
+	tr.Delete(102)
+	if !c.Prev() || c.Key() != 98 {
+		t.Fatal(c.Key())
+	}
+
+	// The tree is mutated elsewhere.
+	tr.Set(99, nil)
+	if !c.Valid() || c.Key() != 98 || !c.Next() || c.Key() != 99 {
+		t.Fatal(c.Key())
+	}
+
+	// Strict.
+	c.SetMode(Strict)
+	if !c.Next() || c.Key() != 104 {
+		t.Fatal(c.Key())
+	}
+
+	tr.Set(-1, nil)
+	if c.Valid() || c.Next() || c.Err() != ErrConcurrentModification {
+		t.Fatal(c.Err())
+	}
+
+	if !c.Seek(104) || c.Err() != nil {
+		t.Fatal(c.Err())
+	}
+
+	tr.Set(104, "changed by someone else")
+	if c.Next() || c.Err() != ErrConcurrentModification {
+		t.Fatal(c.Err())
+	}
+
+	if !c.Seek(104) || c.Err() != nil {
+		t.Fatal(c.Err())
+	}
+
+	// Snapshot.
+	c.SetMode(Snapshot)
+	tr.Delete(106)
+	if !c.Next() || c.Key() != 106 {
+		t.Fatal(c.Key())
+	}
+
+	c.SetMode(Resync)
+	if c.Valid() || !c.Next() || c.Key() != 108 {
+		t.Fatal(c.Key())
+	}
+
+	c.Close()
+}
+
+func TestPartitions(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	for _, N := range []int{0, 1, 100, 1e4, 1e5} {
+		tr := TreeNew(cmp)
+		for _, v := range rng.Perm(N) {
+			tr.Set(v, v)
+		}
+		for _, n := range []int{1, 2, 3, 7, 16} {
+			parts := tr.Partitions(n)
+			if N == 0 {
+				if len(parts) != 0 {
+					t.Fatal(len(parts))
+				}
+
+				continue
+			}
+
+			if len(parts) == 0 || len(parts) > n || N >= 1e4 && len(parts) != n {
+				t.Fatal(N, n, len(parts))
+			}
+
+			var wg sync.WaitGroup
+			counts := make([]int, len(parts))
+			keys := make([][]int, len(parts))
+			for i := range parts {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					en := parts[i].Enumerator()
+					defer en.Close()
+					for {
+						k, _, err := en.Next()
+						if err != nil {
+							return
+						}
+
+						keys[i] = append(keys[i], k.(int))
+						counts[i]++
+					}
+				}(i)
+			}
+			wg.Wait()
+			next := 0
+			for i, a := range keys {
+				for _, k := range a {
+					if k != next {
+						t.Fatal(N, n, i, k, next)
+					}
+
+					next++
+				}
+				if c, e := counts[i], parts[i].Count; N >= 1e4 && (c < e/2 || c > 2*e) {
+					t.Fatal(N, n, i, c, e)
+				}
+
+				if avg := N / len(parts); N >= 1e4 && (counts[i] < avg/2 || counts[i] > 2*avg) {
+					t.Fatal(N, n, i, counts[i], avg)
+				}
+			}
+			if next != N {
+				t.Fatal(N, n, next)
+			}
+		}
+	}
+}
+
+func TestBuildParallel(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	for _, N := range []int{1, 10, 2*kd + 1, 1e3, 1e5} {
+		for _, workers := range []int{0, 1, 3, 8} {
+			for _, mon := range []*Monoid{nil, sumMonoid} {
+				tr := TreeNewOptions(cmp, &Options{Monoid: mon})
+				m := map[int]int{}
+				for i := 0; i < N/3; i++ {
+					k := rng.Intn(N)
+					tr.Set(k, -1)
+					m[k] = -1
+				}
+				items := make([]Item, N)
+				for i := range items {
+					k := rng.Intn(N)
+					items[i] = Item{k, i}
+					m[k] = i
+				}
+				tr.BuildParallel(items, workers)
+				if err := tr.verify(); err != nil {
+					t.Fatal(N, workers, err)
+				}
+
+				if mon != nil {
+					if err := checkAggregates(tr); err != nil {
+						t.Fatal(N, workers, err)
+					}
+				}
+
+				if g, e := tr.Len(), len(m); g != e {
+					t.Fatal(N, workers, g, e)
+				}
+
+				for k, v := range m {
+					if g, ok := tr.Get(k); !ok || g != v {
+						t.Fatal(N, workers, k, g, v)
+					}
+				}
+
+				for i := 0; i < N; i++ {
+					k := rng.Intn(N)
+					tr.Delete(k)
+					tr.Set(rng.Intn(2*N), i)
+				}
+				if err := tr.verify(); err != nil {
+					t.Fatal(N, workers, err)
+				}
+
+				tr.Close()
+			}
+		}
+	}
+}
+
+func TestBuildParallelItems(t *testing.T) {
+	const N = 1e4
+	rng := rand.New(rand.NewSource(42))
+	sorted := func(a []Item) string {
+		a = append([]Item(nil), a...)
+		sort.Slice(a, func(i, j int) bool {
+			if a[i].K != a[j].K {
+				return a[i].K.(int) < a[j].K.(int)
+			}
+
+			return a[i].V.(int) < a[j].V.(int)
+		})
+		return fmt.Sprint(a)
+	}
+	for _, workers := range []int{1, 2, 3} {
+		for _, empty := range []bool{true, false} {
+			tr := TreeNew(cmp)
+			if !empty {
+				tr.Set(-1, -1)
+			}
+			items := make([]Item, N)
+			for i := range items {
+				items[i] = Item{rng.Intn(N / 2), i}
+			}
+			e, e2 := sorted(items), fmt.Sprint(items)
+			tr.BuildParallel(items, workers)
+			if g := sorted(items); g != e {
+				t.Fatal(workers, empty)
+			}
+
+			if g := fmt.Sprint(items); !empty && g != e2 {
+				t.Fatal(workers, empty)
+			}
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	for _, N := range []int{0, 1, 100, 1e4} {
+		tr := TreeNewOptions(cmp, &Options{Monoid: sumMonoid})
+		for _, v := range rng.Perm(N) {
+			tr.Set(v, v)
+		}
+		c := tr.Clone(func(v interface{}) interface{} { return v.(int) + 1 })
+		if err := c.verify(); err != nil {
+			t.Fatal(N, err)
+		}
+
+		if g, e := c.Len(), N; g != e {
+			t.Fatal(N, g, e)
+		}
+
+		for i := 0; i < N; i++ {
+			if v, ok := c.Get(i); !ok || v != i+1 {
+				t.Fatal(N, i, v, ok)
+			}
+
+			if v, ok := tr.Get(i); !ok || v != i {
+				t.Fatal(N, i, v, ok)
+			}
+		}
+
+		// Mutating the clone must not affect the original.
+		for i := 0; i < N; i += 2 {
+			c.Delete(i)
+		}
+		c.Set(N, N)
+		if err := checkAggregates(c); err != nil {
+			t.Fatal(N, err)
+		}
+
+		if err := tr.verify(); err != nil {
+			t.Fatal(N, err)
+		}
+
+		if g, e := tr.Len(), N; g != e {
+			t.Fatal(N, g, e)
+		}
+
+		c2 := tr.Clone(nil)
+		for i := 0; i < N; i++ {
+			if v, ok := c2.Get(i); !ok || v != i {
+				t.Fatal(N, i, v, ok)
+			}
+		}
+		c.Close()
+		c2.Close()
+		tr.Close()
+	}
+}
+
+func TestDiff(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	for _, N := range []int{0, 1, 100, 1e4} {
+		a, b := TreeNew(cmp), TreeNew(cmp)
+		for i := 0; i < N; i++ {
+			a.Set(i, i)
+			b.Set(i, i)
+		}
+		if !a.Equal(b, nil) || a.Diff(b, nil) != nil {
+			t.Fatal(N)
+		}
+
+		m := map[int]DiffKind{}
+		for i := 0; i < N/10; i++ {
+			k := rng.Intn(N)
+			if _, ok := m[k]; ok {
+				continue
+			}
+
+			switch kind := DiffKind(rng.Intn(3)); kind {
+			case DiffAdded:
+				a.Delete(k)
+				m[k] = kind
+			case DiffRemoved:
+				b.Delete(k)
+				m[k] = kind
+			case DiffChanged:
+				b.Set(k, -k-1)
+				m[k] = kind
+			}
+		}
+		b.Set(N, N)
+		m[N] = DiffAdded
+		if a.Equal(b, nil) || b.Equal(a, nil) {
+			t.Fatal(N)
+		}
+
+		c := a.Clone(func(v interface{}) interface{} { return v.(int) + 1 })
+		if !a.Equal(c, func(x, y interface{}) bool { return true }) || N != 0 && a.Equal(c, nil) {
+			t.Fatal(N)
+		}
+
+		last := -1
+		d := a.Diff(b, nil)
+		if g, e := len(d), len(m); g != e {
+			t.Fatal(N, g, e)
+		}
+
+		for _, v := range d {
+			k := v.K.(int)
+			if k <= last {
+				t.Fatal(N, k, last)
+			}
+
+			last = k
+			if g, e := v.Kind, m[k]; g != e {
+				t.Fatal(N, k, g, e)
+			}
+
+			switch v.Kind {
+			case DiffAdded:
+				if v.New != k {
+					t.Fatal(N, v)
+				}
+			case DiffRemoved:
+				if v.Old != k {
+					t.Fatal(N, v)
+				}
+			case DiffChanged:
+				if v.Old != k || v.New != -k-1 {
+					t.Fatal(N, v)
+				}
+			}
+		}
+
+		n := 0
+		a.DiffFunc(b, nil, func(Difference) bool {
+			n++
+			return n < 3
+		})
+		if len(m) >= 3 && n != 3 {
+			t.Fatal(N, n)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	hasher := func(k, v interface{}) uint64 {
+		return uint64(k.(int))*0x9e3779b97f4a7c15 ^ uint64(v.(int))*0xc2b2ae3d27d4eb4f
+	}
+	rng := rand.New(rand.NewSource(42))
+	for _, N := range []int{0, 1, 100, 1e4} {
+		a := TreeNewOptions(cmp, &Options{Hasher: hasher, Monoid: sumMonoid})
+		b := TreeNewOptions(cmp, &Options{Hasher: hasher})
+		for _, v := range rng.Perm(N) {
+			a.Set(v, v)
+		}
+		// Build b with a different shape.
+		for i := 0; i < 2*N; i++ {
+			b.Set(i, -i)
+		}
+		for i := N; i < 2*N; i++ {
+			b.Delete(i)
+		}
+		for i := 0; i < N; i++ {
+			b.Set(i, i)
+		}
+		if g, e := a.RootHash(), b.RootHash(); g != e {
+			t.Fatal(N, g, e)
+		}
+
+		if g, e := a.AggregateAll(), N*(N-1)/2; g != e {
+			t.Fatal(N, g, e)
+		}
+
+		for i := 0; i < 100; i++ {
+			lo, hi := rng.Intn(N+1), rng.Intn(N+1)
+			if g, e := a.RangeHash(lo, hi), b.RangeHash(lo, hi); g != e {
+				t.Fatal(N, lo, hi, g, e)
+			}
+
+			if lo >= hi && a.RangeHash(lo, hi) != 0 {
+				t.Fatal(N, lo, hi)
+			}
+		}
+		if N == 0 {
+			continue
+		}
+
+		k := rng.Intn(N)
+		b.Set(k, -1)
+		if a.RootHash() == b.RootHash() {
+			t.Fatal(N, k)
+		}
+
+		if a.RangeHash(k, k+1) == b.RangeHash(k, k+1) {
+			t.Fatal(N, k)
+		}
+
+		if a.RangeHash(0, k) != b.RangeHash(0, k) || a.RangeHash(k+1, N) != b.RangeHash(k+1, N) {
+			t.Fatal(N, k)
+		}
+
+		// Bisect the difference.
+		lo, hi := 0, N
+		for hi-lo > 1 {
+			m := (lo + hi) / 2
+			if a.RangeHash(lo, m) != b.RangeHash(lo, m) {
+				hi = m
+			} else {
+				lo = m
+			}
+		}
+		if lo != k {
+			t.Fatal(N, lo, k)
+		}
+
+		c := b.Clone(nil)
+		b.Set(k, k)
+		if a.RootHash() != b.RootHash() || c.RootHash() == b.RootHash() {
+			t.Fatal(N, k)
+		}
+	}
+}
+
+func TestObserver(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	tr := TreeNew(cmp)
+	m := map[int]int{}
+	tr.SetObserver(func(op Op, k, oldV, newV interface{}) {
+		switch op {
+		case OpInsert:
+			if _, ok := m[k.(int)]; ok || oldV != nil {
+				t.Fatal(op, k, oldV, newV)
+			}
+
+			m[k.(int)] = newV.(int)
+		case OpUpdate:
+			if v, ok := m[k.(int)]; !ok || v != oldV {
+				t.Fatal(op, k, oldV, newV, v, ok)
+			}
+
+			m[k.(int)] = newV.(int)
+		case OpDelete:
+			if v, ok := m[k.(int)]; !ok || v != oldV || newV != nil {
+				t.Fatal(op, k, oldV, newV, v, ok)
+			}
+
+			delete(m, k.(int))
+		case OpClear:
+			if k != nil || oldV != nil || newV != nil {
+				t.Fatal(op, k, oldV, newV)
+			}
+
+			m = map[int]int{}
+		}
+	})
+	check := func(i int) {
+		if g, e := tr.Len(), len(m); g != e {
+			t.Fatal(i, g, e)
+		}
+
+		for k, v := range m {
+			if g, ok := tr.Get(k); !ok || g != v {
+				t.Fatal(i, k, g, v)
+			}
+		}
+	}
+	const N = 1000
+	for i := 0; i < 20*N; i++ {
+		k := rng.Intn(N)
+		switch rng.Intn(12) {
+		case 0, 1, 2:
+			tr.Set(k, i)
+		case 3:
+			tr.Put(k, func(old interface{}, ok bool) (interface{}, bool) { return i, ok })
+		case 4:
+			tr.Put(k, func(old interface{}, ok bool) (interface{}, bool) { return i, !ok })
+		case 5, 6:
+			tr.Delete(k)
+		case 7:
+			tr.PopFirst()
+		case 8:
+			tr.PopLast()
+		case 9:
+			tr.PopFirstN(rng.Intn(10))
+		case 10:
+			e, _ := tr.Seek(k)
+			for j := 0; j < 5; j++ {
+				if _, _, err := e.Next(); err != nil {
+					break
+				}
+
+				if j%2 == 0 {
+					e.Delete()
+				} else {
+					e.SetValue(-i)
+				}
+			}
+			e.Close()
+		case 11:
+			if rng.Intn(100) == 0 {
+				tr.Clear()
+				break
+			}
+
+			items := make([]Item, rng.Intn(10))
+			for j := range items {
+				items[j] = Item{rng.Intn(N), i + j}
+			}
+			tr.BuildParallel(items, 2)
+		}
+		check(i)
+	}
+
+	c := make(chan Change, 3)
+	tr.SetObserver(ChanObserver(c))
+	tr.Clear()
+	tr.Set(1, 1)
+	tr.Set(1, 2)
+	if g, e := fmt.Sprint(<-c, <-c, <-c), "{3 <nil> <nil> <nil>} {0 1 <nil> 1} {1 1 1 2}"; g != e {
+		t.Fatalf("got %s, expected %s", g, e)
+	}
+
+	tr.SetObserver(nil)
+	tr.Set(2, 2)
+	select {
+	case ch := <-c:
+		t.Fatal(ch)
+	default:
+	}
+}
+
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) add(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestExpiringTree(t *testing.T) {
+	clock := &testClock{now: time.Unix(1e9, 0)}
+	tr := ExpiringTreeNew(cmp, clock)
+	defer tr.Close()
+
+	const N = 1000
+	for i := 0; i < N; i++ {
+		switch i % 3 {
+		case 0:
+			tr.Set(i, i)
+		default:
+			tr.SetWithTTL(i, i, time.Duration(i%3)*time.Second)
+		}
+	}
+	tr.SetWithTTL(0, 0, time.Second)
+	tr.Set(0, 0)           // Clears the TTL.
+	tr.SetWithTTL(3, 3, 0) // Removes the item.
+	if g, e := tr.Len(), N-1; g != e {
+		t.Fatal(g, e)
+	}
+
+	for i := 4; i < N; i++ {
+		if v, ok := tr.Get(i); !ok || v != i {
+			t.Fatal(i, v, ok)
+		}
+	}
+
+	clock.add(time.Second)
+	for i := 4; i < 100; i++ {
+		_, ok := tr.Get(i)
+		if g, e := ok, i%3 != 1; g != e {
+			t.Fatal(i, g, e)
+		}
+	}
+
+	// Expired items are hidden from the enumerators.
+	e, err := tr.SeekFirst()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	for {
+		k, v, err := e.Next()
+		if err != nil {
+			break
+		}
+
+		if k.(int)%3 == 1 || k != v {
+			t.Fatal(k, v)
+		}
+
+		n++
+	}
+	e.Close()
+	if _, ok := tr.Seek(1); ok {
+		t.Fatal(1)
+	}
+
+	if _, ok := tr.Seek(2); !ok {
+		t.Fatal(2)
+	}
+
+	if tr.Delete(4) || !tr.Delete(5) {
+		t.Fatal(4, 5)
+	}
+
+	if g, e := tr.Sweep(), N/3-(100-4)/3; g != e { // i%3 == 1 not removed by Get
+		t.Fatal(g, e)
+	}
+
+	if g, e := tr.Len(), n-1; g != e {
+		t.Fatal(g, e)
+	}
+
+	// Background sweeping.
+	clock.add(time.Second)
+	tr.SweepEvery(time.Millisecond)
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+		l := tr.Len()
+		if l == N/3 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal(l)
+		}
+	}
+	for i := 0; i < N; i++ {
+		_, ok := tr.Get(i)
+		if g, e := ok, i%3 == 0 && i != 3; g != e {
+			t.Fatal(i, g, e)
+		}
+	}
+}
+
+func TestMaxItems(t *testing.T) {
+	const M = 100
+	rng := rand.New(rand.NewSource(42))
+	for _, policy := range []EvictionPolicy{EvictSmallest, EvictLargest, EvictLRU} {
+		var evicted []int
+		tr := TreeNewOptions(cmp, &Options{
+			Evict:    policy,
+			MaxItems: M,
+			Monoid:   sumMonoid,
+			OnEvict: func(k, v interface{}) {
+				if k != v {
+					t.Fatal(k, v)
+				}
+
+				evicted = append(evicted, k.(int))
+			},
+		})
+		var observed []int
+		tr.SetObserver(func(op Op, k, oldV, newV interface{}) {
+			if op == OpDelete {
+				observed = append(observed, k.(int))
+			}
+		})
+		var use []int // reference LRU, most recent last
+		used := func(k int) {
+			for i, v := range use {
+				if v == k {
+					use = append(use[:i], use[i+1:]...)
+					break
+				}
+			}
+			use = append(use, k)
+		}
+		for i := 0; i < 20*M; i++ {
+			k := rng.Intn(3 * M)
+			switch rng.Intn(3) {
+			case 0:
+				if _, ok := tr.Get(k); ok {
+					used(k)
+				}
+				continue
+			default:
+				_, exists := tr.Get(k)
+				tr.Set(k, k)
+				used(k)
+				if exists || tr.Len() < M {
+					if len(evicted) != 0 {
+						t.Fatal(policy, i, evicted)
+					}
+
+					continue
+				}
+			}
+
+			if tr.Len() != M {
+				t.Fatal(policy, i, tr.Len())
+			}
+
+			if len(evicted) > 1 {
+				t.Fatal(policy, i, evicted)
+			}
+
+			if len(evicted) == 0 {
+				continue
+			}
+
+			e := evicted[0]
+			if _, ok := tr.Get(e); ok {
+				t.Fatal(policy, i, e)
+			}
+
+			switch policy {
+			case EvictSmallest:
+				if k, _ := tr.First(); k.(int) < e {
+					t.Fatal(policy, i, k, e)
+				}
+			case EvictLargest:
+				if k, _ := tr.Last(); k.(int) > e {
+					t.Fatal(policy, i, k, e)
+				}
+			case EvictLRU:
+				if use[0] != e {
+					t.Fatal(policy, i, use[0], e)
+				}
+
+				use = use[1:]
+			}
+			if g, e := fmt.Sprint(observed), fmt.Sprint(evicted); g != e {
+				t.Fatal(policy, i, g, e)
+			}
+
+			evicted, observed = evicted[:0], observed[:0]
+		}
+		if err := checkAggregates(tr); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 3*M; i += 2 {
+			tr.Delete(i)
+		}
+		tr.PopFirst()
+		tr.PopLast()
+		for i := 0; i < 3*M; i++ {
+			tr.Set(i, i)
+		}
+		if g, e := tr.Len(), M; g != e {
+			t.Fatal(policy, g, e)
+		}
+
+		if policy == EvictLRU {
+			if g, e := fmt.Sprint(tr.First()), fmt.Sprint(2*M, 2*M); g != e {
+				t.Fatal(policy, g, e)
+			}
+		}
+
+		tr.Clear()
+		tr.Set(1, 1)
+		if g, e := tr.Len(), 1; g != e {
+			t.Fatal(policy, g, e)
+		}
+
+		tr.Close()
+	}
+}
+
+func TestMaxItemsBatch(t *testing.T) {
+	const M = 3
+	for _, test := range []struct {
+		policy EvictionPolicy
+		events string
+	}{
+		{EvictSmallest, "I0 I1 I2 I3 I4 I5 D0 D1 D2"},
+		{EvictLargest, "I0 I1 I2 I3 I4 I5 D5 D4 D3"},
+		{EvictLRU, "I0 I1 I2 I3 I4 I5 D0 D1 D2"},
+	} {
+		for _, parallel := range []bool{false, true} {
+			tr := TreeNewOptions(cmp, &Options{Evict: test.policy, MaxItems: M})
+			var events []string
+			tr.SetObserver(func(op Op, k, oldV, newV interface{}) {
+				events = append(events, fmt.Sprintf("%c%v", "IUDC"[op], k))
+			})
+			switch {
+			case parallel:
+				var items []Item
+				for i := 5; i >= 0; i-- {
+					items = append(items, Item{i, i})
+				}
+				tr.BuildParallel(items, 2)
+			default:
+				var ops []Mutation
+				for i := 0; i < 6; i++ {
+					ops = append(ops, Mutation{K: i, V: i})
+				}
+				tr.ApplySorted(ops)
+			}
+			if g, e := strings.Join(events, " "), test.events; g != e {
+				t.Fatalf("%v %v\n%s\n%s", test.policy, parallel, g, e)
+			}
+
+			if g, e := tr.Len(), M; g != e {
+				t.Fatal(test.policy, parallel, g, e)
+			}
+
+			if err := tr.verify(); err != nil {
+				t.Fatal(test.policy, parallel, err)
+			}
+		}
+	}
+}
+
+func TestSizer(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	sizer := func(k, v interface{}) int { return 8 + len(v.(string)) }
+	pages := func(tr *Tree) int {
+		return tr.nd*int(unsafe.Sizeof(d{})) + tr.nx*int(unsafe.Sizeof(x{})) + int(unsafe.Sizeof(Tree{}))
+	}
+	tr := TreeNewOptions(cmp, &Options{Sizer: sizer})
+	if g, e := tr.Bytes(), pages(tr); g != e {
+		t.Fatal(g, e)
+	}
+
+	m := map[int]string{}
+	const N = 1000
+	for i := 0; i < 20*N; i++ {
+		k := rng.Intn(N)
+		v := strings.Repeat("x", rng.Intn(100))
+		switch rng.Intn(6) {
+		case 0, 1:
+			tr.Set(k, v)
+			m[k] = v
+		case 2:
+			tr.Delete(k)
+			delete(m, k)
+		case 3:
+			if k, _, ok := tr.PopFirst(); ok {
+				delete(m, k.(int))
+			}
+		case 4:
+			e, _ := tr.Seek(k)
+			if k, _, err := e.Next(); err == nil {
+				e.SetValue(v)
+				m[k.(int)] = v
+			}
+			e.Close()
+		case 5:
+			if rng.Intn(1000) == 0 {
+				tr.Clear()
+				m = map[int]string{}
+			}
+		}
+		n := 0
+		for k, v := range m {
+			n += sizer(k, v)
+		}
+		if g, e := tr.Bytes(), n+pages(tr); g != e {
+			t.Fatal(i, g, e)
+		}
+	}
+	if err := tr.verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := tr.Clone(func(v interface{}) interface{} { return v.(string) + "y" })
+	if g, e := c.Bytes(), tr.Bytes()+tr.Len(); g != e {
+		t.Fatal(g, e)
+	}
+
+	// Bounded by MaxBytes.
+	const M = 1 << 16
+	evicted := 0
+	tr = TreeNewOptions(cmp, &Options{
+		Evict:    EvictLargest,
+		MaxBytes: M,
+		OnEvict:  func(k, v interface{}) { evicted++ },
+		Sizer:    sizer,
+	})
+	for i := 0; i < N; i++ {
+		tr.Set(rng.Intn(N), strings.Repeat("x", rng.Intn(1000)))
+		if g := tr.Bytes(); g > M {
+			t.Fatal(i, g)
+		}
+	}
+	if evicted == 0 {
+		t.Fatal(evicted)
+	}
+
+	if err := tr.verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConditional(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	tr := TreeNewOptions(cmp, &Options{Monoid: sumMonoid})
+	m := map[int]int{}
+	var ops int
+	tr.SetObserver(func(op Op, k, oldV, newV interface{}) {
+		ops++
+		switch op {
+		case OpInsert:
+			if _, ok := m[k.(int)]; ok {
+				t.Fatal(op, k)
+			}
+		case OpUpdate, OpDelete:
+			if v, ok := m[k.(int)]; !ok || v != oldV {
+				t.Fatal(op, k, oldV, v, ok)
+			}
+		}
+	})
+	const N = 1000
+	for i := 0; i < 50*N; i++ {
+		k, v := rng.Intn(N), rng.Intn(10)
+		old, exists := m[k]
+		n := ops
+		switch rng.Intn(4) {
+		case 0:
+			actual, loaded := tr.SetIfAbsent(k, v)
+			if loaded != exists || exists && actual != old || !exists && actual != v {
+				t.Fatal(i, k, v, actual, loaded)
+			}
+
+			if !exists {
+				m[k] = v
+			}
+		case 1:
+			want := rng.Intn(10)
+			swapped := tr.CompareAndSwap(k, want, v, nil)
+			if g, e := swapped, exists && old == want; g != e {
+				t.Fatal(i, k, want, v, g, e)
+			}
+
+			if swapped {
+				m[k] = v
+			}
+		case 2:
+			want := rng.Intn(10)
+			deleted := tr.CompareAndDelete(k, want, func(a, b interface{}) bool { return a.(int)%2 == b.(int)%2 })
+			if g, e := deleted, exists && old%2 == want%2; g != e {
+				t.Fatal(i, k, want, g, e)
+			}
+
+			if deleted {
+				delete(m, k)
+			}
+		case 3:
+			deleted := tr.DeleteIf(k, func(v interface{}) bool { return v.(int) < 5 })
+			if g, e := deleted, exists && old < 5; g != e {
+				t.Fatal(i, k, g, e)
+			}
+
+			if deleted {
+				delete(m, k)
+			}
+		}
+		if g, e := tr.Len(), len(m); g != e {
+			t.Fatal(i, g, e)
+		}
+
+		if ops-n > 1 {
+			t.Fatal(i, ops-n)
+		}
+	}
+	if err := tr.verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkAggregates(tr); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range m {
+		if g, ok := tr.Get(k); !ok || g != v {
+			t.Fatal(k, g, v)
+		}
+	}
+
+	tr = TreeNew(cmp)
+	tr.Set(1, 1)
+	if n := testing.AllocsPerRun(100, func() {
+		tr.SetIfAbsent(1, 2)
+		tr.CompareAndSwap(1, 1, 1, nil)
+	}); n != 0 {
+		t.Fatal(n)
+	}
+}
+
+func TestDeleteFunc(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	for _, N := range []int{0, 1, 2 * kd, 2*kd + 1, 1000, 1e4} {
+		for _, mod := range []int{1, 2, 3, 10, 1000, 1e6} {
+			tr := TreeNewOptions(cmp, &Options{Monoid: sumMonoid})
+			for _, v := range rng.Perm(N) {
+				tr.Set(v, v)
+			}
+			removed := 0
+			tr.SetObserver(func(op Op, k, oldV, newV interface{}) {
+				if op != OpDelete || k.(int)%mod != 0 {
+					t.Fatal(op, k)
+				}
+
+				removed++
+			})
+			e, _ := tr.SeekFirst()
+			n := tr.DeleteFunc(func(k, v interface{}) bool { return k.(int)%mod == 0 })
+			if g, e := n, (N+mod-1)/mod; g != e {
+				t.Fatal(N, mod, g, e)
+			}
+
+			if g, e := removed, n; g != e {
+				t.Fatal(N, mod, g, e)
+			}
+
+			if err := tr.verify(); err != nil {
+				t.Fatal(N, mod, err)
+			}
+
+			if err := checkAggregates(tr); err != nil {
+				t.Fatal(N, mod, err)
+			}
+
+			if g, e := tr.Len(), N-n; g != e {
+				t.Fatal(N, mod, g, e)
+			}
+
+			// The enumerator resyncs.
+			if e != nil {
+				c := 0
+				for j := 0; ; j++ {
+					k, _, err := e.Next()
+					if err != nil {
+						break
+					}
+
+					if j%mod == 0 {
+						j++
+					}
+					if k != j {
+						t.Fatal(N, mod, k, j)
+					}
+
+					c++
+				}
+				if g, e := c, N-n; g != e {
+					t.Fatal(N, mod, g, e)
+				}
+			}
+
+			tr.SetObserver(nil)
+			for i := 0; i < N; i++ {
+				tr.Set(rng.Intn(N), i)
+				tr.Delete(rng.Intn(N))
+			}
+			if err := tr.verify(); err != nil {
+				t.Fatal(N, mod, err)
+			}
+		}
+	}
+}
+
+func TestDeleteFuncNone(t *testing.T) {
+	const N = 1e4
+	rng := rand.New(rand.NewSource(42))
+	tr := TreeNew(cmp)
+	for _, v := range rng.Perm(N) {
+		tr.Set(v, v)
+	}
+	en, _ := tr.SeekFirst()
+	en.SetMode(Strict)
+	if _, _, err := en.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := tr.DeleteFunc(func(k, v interface{}) bool { return false }), 0; g != e {
+		t.Fatal(g, e)
+	}
+
+	if k, _, err := en.Next(); err != nil || k != 1 {
+		t.Fatal(k, err)
+	}
+
+	// Only the items following the first removed one are moved.
+	for _, k := range []int{N - 1, N / 2} {
+		if g, e := tr.DeleteFunc(func(k0, v interface{}) bool { return k0 == k }), 1; g != e {
+			t.Fatal(k, g, e)
+		}
+
+		if err := tr.verify(); err != nil {
+			t.Fatal(k, err)
+		}
+	}
+	for i := 0; i < N; i++ {
+		if _, ok := tr.Get(i); ok != (i != N-1 && i != N/2) {
+			t.Fatal(i, ok)
+		}
+	}
+}
+
+func TestApplySorted(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	for _, N := range []int{0, 1, 100, 1e4} {
+		for _, batch := range []int{1, 10, 1000, 1e4} {
+			for _, sorted := range []bool{true, false} {
+				tr := TreeNewOptions(cmp, &Options{Monoid: sumMonoid})
+				m := map[int]int{}
+				for _, v := range rng.Perm(N) {
+					tr.Set(v, v)
+					m[v] = v
+				}
+				ops := 0
+				tr.SetObserver(func(op Op, k, oldV, newV interface{}) {
+					ops++
+					switch op {
+					case OpInsert:
+						if _, ok := m[k.(int)]; ok {
+							t.Fatal(op, k)
+						}
+
+						m[k.(int)] = newV.(int)
+					case OpUpdate:
+						if v, ok := m[k.(int)]; !ok || v != oldV {
+							t.Fatal(op, k, v, oldV)
+						}
+
+						m[k.(int)] = newV.(int)
+					case OpDelete:
+						if v, ok := m[k.(int)]; !ok || v != oldV {
+							t.Fatal(op, k, v, oldV)
+						}
+
+						delete(m, k.(int))
+					}
+				})
+				for round := 0; round < 5; round++ {
+					a := make([]Mutation, batch)
+					for i := range a {
+						a[i] = Mutation{rng.Intn(3) == 0, rng.Intn(2*N + 10), rng.Intn(1000)}
+					}
+					if sorted {
+						sort.SliceStable(a, func(i, j int) bool { return a[i].K.(int) < a[j].K.(int) })
+					}
+					ref := map[int]int{}
+					for k, v := range m {
+						ref[k] = v
+					}
+					for _, op := range a {
+						if op.Delete {
+							delete(ref, op.K.(int))
+							continue
+						}
+
+						ref[op.K.(int)] = op.V.(int)
+					}
+					tr.ApplySorted(a)
+					if err := tr.verify(); err != nil {
+						t.Fatal(N, batch, sorted, err)
+					}
+
+					if err := checkAggregates(tr); err != nil {
+						t.Fatal(N, batch, sorted, err)
+					}
+
+					if g, e := tr.Len(), len(ref); g != e {
+						t.Fatal(N, batch, sorted, g, e)
+					}
+
+					if g, e := len(m), len(ref); g != e {
+						t.Fatal(N, batch, sorted, g, e)
+					}
+
+					for k, v := range ref {
+						if g, ok := tr.Get(k); !ok || g != v {
+							t.Fatal(N, batch, sorted, k, g, v)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestApplySortedDeep(t *testing.T) {
+	const N = 5e4
+	rng := rand.New(rand.NewSource(42))
+	for _, mon := range []*Monoid{nil, sumMonoid} {
+		tr := TreeNewOptions(cmp, &Options{Monoid: mon})
+		m := map[int]int{}
+		for i := 0; i < N; i++ {
+			k, v := rng.Int(), rng.Intn(1000)
+			tr.Set(k, v)
+			m[k] = v
+		}
+		if r, ok := tr.r.(*x); !ok {
+			t.Fatal("tree too shallow")
+		} else if _, ok := r.x[0].ch.(*x); !ok {
+			t.Fatal("tree too shallow")
+		}
+
+		for round := 0; round < 50; round++ {
+			a := make([]Mutation, 2000)
+			for i := range a {
+				k, v := rng.Int(), rng.Intn(1000)
+				a[i] = Mutation{K: k, V: v}
+				m[k] = v
+			}
+			sort.Slice(a, func(i, j int) bool { return a[i].K.(int) < a[j].K.(int) })
+			tr.ApplySorted(a)
+			if err := tr.verify(); err != nil {
+				t.Fatal(round, err)
+			}
+
+			if mon == nil {
+				continue
+			}
+
+			if err := checkAggregates(tr); err != nil {
+				t.Fatal(round, err)
+			}
+		}
+		if g, e := tr.Len(), len(m); g != e {
+			t.Fatal(g, e)
+		}
+
+		for k, v := range m {
+			if g, ok := tr.Get(k); !ok || g != v {
+				t.Fatal(k, g, v)
+			}
+		}
+	}
+}
+
+func TestSeekFrom(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	var cmps int
+	tr := TreeNew(func(a, b interface{}) int { cmps++; return cmp(a, b) })
+	const N = 10000
+	for _, v := range rng.Perm(N) {
+		tr.Set(2*v, v)
+	}
+	e, _ := tr.SeekFirst()
+	defer e.Close()
+	for i := 0; i < 1e4; i++ {
+		var k int
+		switch rng.Intn(3) {
+		case 0:
+			k = rng.Intn(2*N+10) - 5
+		default:
+			k = e.k.(int) + rng.Intn(200) - 100
+		}
+		switch rng.Intn(10) {
+		case 0:
+			tr.Set(2*rng.Intn(N), -1)
+		case 2:
+			if _, _, err := e.Next(); err == nil {
+				e.Delete()
+			}
+		case 1:
+			// Split or merge the pages near e.
+			for j := 0; j < 2*kd; j++ {
+				switch k := e.k.(int) + rng.Intn(400) - 200; rng.Intn(2) {
+				case 0:
+					tr.Set(k, -1)
+				default:
+					tr.Delete(k)
+				}
+			}
+		}
+		f, hit := tr.Seek(k)
+		if g, e := e.SeekFrom(k), hit; g != e {
+			t.Fatal(i, k, g, e)
+		}
+
+		for j := 0; j < 3; j++ {
+			var g, e0 interface{}
+			var err, err0 error
+			switch j {
+			case 1:
+				g, _, err = e.Prev()
+				e0, _, err0 = f.Prev()
+			default:
+				g, _, err = e.Next()
+				e0, _, err0 = f.Next()
+			}
+			if g != e0 || err != err0 {
+				t.Fatal(i, k, j, g, e0, err, err0)
+			}
+
+			if e.pver != tr.ver || len(e.path) == 0 {
+				continue
+			}
+
+			var q interface{} = tr.r
+			for _, p := range e.path {
+				if p.x != q {
+					t.Fatal(i, j, "bad path")
+				}
+
+				q = p.x.x[p.i].ch
+			}
+			if q != e.q {
+				t.Fatal(i, j, "path does not lead to e.q")
+			}
+		}
+		f.Close()
+	}
+
+	e.SeekFrom(N)
+	cmps = 0
+	e.SeekFrom(N + 20)
+	near := cmps
+	cmps = 0
+	tr.Seek(N + 20)
+	if near >= cmps {
+		t.Fatal(near, cmps)
+	}
+
+	// The path follows e through the data pages.
+	for i := 0; i < 4*kd; i++ {
+		e.Next()
+	}
+	k := e.k.(int) + 20
+	cmps = 0
+	e.SeekFrom(k)
+	near = cmps
+	cmps = 0
+	tr.Seek(k)
+	if near >= cmps {
+		t.Fatal(near, cmps)
+	}
+}
+
+func TestEstimateRange(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	for _, N := range []int{0, 1, 100, 1e4, 1e5} {
+		tr := TreeNew(cmp)
+		for _, v := range rng.Perm(N) {
+			tr.Set(v, v)
+		}
+		for _, v := range rng.Perm(N)[:N/3] {
+			tr.Delete(v)
+		}
+		keys := []int{}
+		tr.DeleteFunc(func(k, v interface{}) bool {
+			keys = append(keys, k.(int))
+			return false
+		})
+		count := func(lo, hi int) int { return sort.SearchInts(keys, hi) - sort.SearchInts(keys, lo) }
+		if g, e := count(-1, N), len(keys); g != e {
+			t.Fatal(g, e)
+		}
+
+		for i := 0; i < 1000; i++ {
+			lo := rng.Intn(N+20) - 10
+			hi := lo + rng.Intn(N+20)
+			if rng.Intn(4) == 0 {
+				hi = lo + rng.Intn(100)
+			}
+			n, maxErr := tr.EstimateRange(lo, hi)
+			e := count(lo, hi)
+			if n < e-maxErr || n > e+maxErr {
+				t.Fatal(N, lo, hi, n, maxErr, e)
+			}
+
+			if N >= 1e4 && e > N/10 && (n < e*3/4 || n > e*5/4) {
+				t.Fatal(N, lo, hi, n, maxErr, e)
+			}
+		}
+
+		if g, e := tr.EstimateRange(-1, N); g != len(keys) || e != 0 {
+			t.Fatal(N, g, e)
+		}
+
+		if len(keys) > 10 {
+			lo, hi := keys[0], keys[10]
+			if g, e := tr.EstimateRange(lo, hi); g != 10 || e != 0 {
+				t.Fatal(N, g, e)
+			}
+		}
+
+		if g, e := tr.EstimateRange(N, -1); g != 0 || e != 0 {
+			t.Fatal(N, g, e)
+		}
+	}
+}
+
+func TestEstimateRangeCount(t *testing.T) {
+	const N = 1e4
+	rng := rand.New(rand.NewSource(42))
+	count := &Monoid{
+		Zero:     0,
+		FromItem: func(k, v interface{}) interface{} { return 1 },
+		Combine:  func(a, b interface{}) interface{} { return a.(int) + b.(int) },
+		Count:    func(a interface{}) int { return a.(int) },
+	}
+	for _, hasher := range []Hasher{nil, func(k, v interface{}) uint64 { return uint64(k.(int)) }} {
+		tr := TreeNewOptions(cmp, &Options{Monoid: count, Hasher: hasher})
+		keys := rng.Perm(N)[:N/2]
+		for _, k := range keys {
+			tr.Set(k, k)
+		}
+		sort.Ints(keys)
+		for i := 0; i < 1000; i++ {
+			lo := rng.Intn(N+20) - 10
+			hi := lo + rng.Intn(N+20)
+			e := sort.SearchInts(keys, hi) - sort.SearchInts(keys, lo)
+			if n, maxErr := tr.EstimateRange(lo, hi); n != e || maxErr != 0 {
+				t.Fatal(lo, hi, n, maxErr, e)
+			}
+		}
+	}
+}
+
+func TestRandomItem(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	tr := TreeNewOptions(cmp, &Options{Seed: 42})
+	if _, _, ok := tr.RandomItem(nil); ok {
+		t.Fatal(ok)
+	}
+
+	// Make the fill of the pages uneven: sequential inserts leave the data
+	// pages half full, random inserts fill them more.
+	const N = 5000
+	for v := 0; v < N; v++ {
+		tr.Set(v, v)
+	}
+	for _, v := range rng.Perm(N) {
+		tr.Set(N+v, N+v)
+	}
+	if _, ok := tr.r.(*x).x[0].ch.(*x); !ok {
+		t.Fatal("tree too small")
+	}
+
+	m := map[int]int{}
+	for q := tr.first; q != nil; q = q.n {
+		for _, it := range q.d[:q.c] {
+			m[it.k.(int)] = 0
+		}
+	}
+	n := len(m)
+
+	const draws = 100
+	for i := 0; i < draws*n; i++ {
+		k, v, ok := tr.RandomItem(rng)
+		if !ok || k != v {
+			t.Fatal(k, v, ok)
+		}
+
+		if _, ok := m[k.(int)]; !ok {
+			t.Fatal(k)
+		}
+
+		m[k.(int)]++
+	}
+	// Chi-squared test of the uniformity, n-1 degrees of freedom.
+	chi2 := 0.
+	for _, c := range m {
+		d := float64(c - draws)
+		chi2 += d * d / draws
+	}
+	if df := float64(n - 1); chi2 > df+6*math.Sqrt(2*df) {
+		t.Fatal(n, chi2)
+	}
+
+	c := tr.Clone(nil)
+	for i := 0; i < 100; i++ {
+		k, _, _ := c.RandomItem(nil)
+		if k3, _, _ := tr.RandomItem(nil); k3 != k {
+			t.Fatal(i, k, k3)
+		}
+	}
+}
+
+func TestSample(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	tr := TreeNew(cmp)
+	const N = 1e4
+	for _, v := range rng.Perm(N) {
+		tr.Set(v, v)
+	}
+	for _, test := range []struct{ lo, hi, n int }{
+		{0, N, 10},
+		{0, N, N},
+		{-10, 2 * N, 20},
+		{100, 1000, 10},
+		{100, 1000, 500},
+		{1000, 1010, 5},
+		{1000, 1010, 20},
+		{62, 66, 2},
+		{N - 100, N, 30},
+		{5, 5, 1},
+	} {
+		lo, hi := test.lo, test.hi
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > N {
+			hi = N
+		}
+		m := hi - lo
+		if m < 0 {
+			m = 0
+		}
+		counts := make([]int, m)
+		const rounds = 400
+		for round := 0; round < rounds; round++ {
+			r := tr.Sample(test.lo, test.hi, test.n, rng)
+			e := test.n
+			if e > m {
+				e = m
+			}
+			if g := len(r); g != e {
+				t.Fatal(test, g, e)
+			}
+
+			for i, it := range r {
+				k := it.K.(int)
+				if k < lo || k >= hi || it.V != k || i > 0 && r[i-1].K.(int) >= k {
+					t.Fatal(test, i, it)
+				}
+
+				counts[k-lo]++
+			}
+		}
+		if m == 0 || test.n >= m {
+			continue
+		}
+
+		// Chi-squared test of the uniformity of the inclusion of the
+		// items, m-1 degrees of freedom.
+		p := float64(test.n) / float64(m)
+		e := rounds * p
+		chi2 := 0.
+		for _, c := range counts {
+			d := float64(c) - e
+			chi2 += d * d / (e * (1 - p))
+		}
+		if df := float64(m - 1); chi2 > df+6*math.Sqrt(2*df)+10 {
+			t.Fatal(test, chi2, df)
+		}
+	}
+	if r := TreeNew(cmp).Sample(0, 1, 1, nil); r != nil {
+		t.Fatal(r)
+	}
+}
+
+func TestRandomConcurrent(t *testing.T) {
+	const N = 1e4
+	tr := TreeNewOptions(cmp, &Options{Seed: 42})
+	for i := 0; i < N; i++ {
+		tr.Set(i, i)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if k, _, ok := tr.RandomItem(nil); !ok || k.(int) < 0 || k.(int) >= N {
+					t.Error(k, ok)
+					return
+				}
+
+				if a := tr.Sample(100, 200, 10, nil); len(a) != 10 {
+					t.Error(len(a))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// totalOrder checks that c is a total order of keys.
+func totalOrder(c Cmp, keys []interface{}) error {
+	sgn := func(n int) int {
+		switch {
+		case n < 0:
+			return -1
+		case n > 0:
+			return 1
+		default:
+			return 0
+		}
+	}
+	for _, a := range keys {
+		if r := c(a, a); r != 0 {
+			return fmt.Errorf("not reflexive: %v %v", a, r)
+		}
+
+		for _, b := range keys {
+			if sgn(c(a, b)) != -sgn(c(b, a)) {
+				return fmt.Errorf("not antisymmetric: %v %v", a, b)
+			}
+
+			if c(a, b) > 0 {
+				continue
+			}
+
+			for _, k := range keys {
+				if c(b, k) <= 0 && c(a, k) > 0 {
+					return fmt.Errorf("not transitive: %v %v %v", a, b, k)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func TestCmp(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	ints := []interface{}{math.MinInt64, math.MinInt64 + 1, -1, 0, 1, math.MaxInt64 - 1, math.MaxInt64}
+	for i := 0; i < 10; i++ {
+		ints = append(ints, int(rng.Uint64()))
+	}
+	if totalOrder(func(a, b interface{}) int { return a.(int) - b.(int) }, ints) == nil {
+		t.Fatal("subtraction of ints is not a total order")
+	}
+
+	strs := []interface{}{"", "\x00", "a", "ab", "b", "\xff", "\xff\xff"}
+	bs := []interface{}{[]byte(nil), []byte{}, []byte{0}, []byte("a"), []byte("ab"), []byte{0xff}}
+	now := time.Now()
+	times := []interface{}{time.Time{}, now, now.Add(-1), now.Add(time.Hour), now.UTC(), now.Round(0), time.Unix(0, 0), time.Unix(0, 0).In(time.FixedZone("X", 3600))}
+	type pt struct{ X, Y int }
+	var tuples, structs, arrays []interface{}
+	for i := 0; i < 20; i++ {
+		x, y := rng.Intn(3), rng.Intn(3)
+		tuples = append(tuples, []interface{}{strs[x], ints[y], ints[rng.Intn(3)]}[:1+rng.Intn(3)])
+		structs = append(structs, pt{x, y})
+		arrays = append(arrays, [2]int{x, y})
+	}
+	withNils := append([]interface{}{nil, nil}, ints...)
+	for i, test := range []struct {
+		c    Cmp
+		keys []interface{}
+	}{
+		{Ints, ints},
+		{Strings, strs},
+		{Bytes, bs},
+		{Time, times},
+		{Reverse(Ints), ints},
+		{Reverse(Reverse(Strings)), strs},
+		{Tuple(Strings, Ints), tuples},
+		{Tuple(Strings, Reverse(Ints), Ints), tuples},
+		{Tuple(), tuples},
+		{Tuple(Ints, Reverse(Ints)), structs},
+		{Tuple(Ints, Ints), arrays},
+		{NilsFirst(Ints), withNils},
+		{NilsLast(Reverse(Ints)), withNils},
+	} {
+		if err := totalOrder(test.c, test.keys); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+
+	if g, e := Time(now, now.UTC()), 0; g != e {
+		t.Fatal(g, e)
+	}
+
+	if g, e := Bytes([]byte(nil), []byte{}), 0; g != e {
+		t.Fatal(g, e)
+	}
+
+	for _, test := range []struct {
+		c    Cmp
+		a, b interface{}
+		e    int
+	}{
+		{Ints, math.MinInt64, 1, -1},
+		{Reverse(Ints), 1, 2, 1},
+		{NilsFirst(Ints), nil, math.MinInt64, -1},
+		{NilsLast(Ints), nil, math.MaxInt64, 1},
+		{Tuple(Strings, Ints), []interface{}{"a"}, []interface{}{"a", 1}, -1},
+		{Tuple(Strings, Ints), []interface{}{"a", 2}, []interface{}{"b", 1}, -1},
+		{Tuple(Strings, Reverse(Ints)), []interface{}{"a", 2}, []interface{}{"a", 1}, -1},
+		{Tuple(Strings), []interface{}{"a", 2}, []interface{}{"a", 1}, 0},
+		{Tuple(Ints, Ints), pt{1, 2}, []interface{}{1, 3}, -1},
+	} {
+		if g := test.c(test.a, test.b); g != test.e {
+			t.Fatal(test.a, test.b, g, test.e)
+		}
+	}
+
+	tr := TreeNew(Tuple(Strings, Reverse(Ints)))
+	tr.Set([]interface{}{"b", 1}, nil)
+	tr.Set([]interface{}{"a", 1}, nil)
+	tr.Set([]interface{}{"a", 2}, nil)
+	if k, _ := tr.First(); Tuple(Strings, Ints)(k, []interface{}{"a", 2}) != 0 {
+		t.Fatal(k)
+	}
+}
@@ -5,9 +5,15 @@
 package b
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"math/bits"
+	"math/rand"
+	"runtime"
+	"sort"
 	"sync"
+	"unsafe"
 )
 
 const (
@@ -25,6 +31,73 @@ func init() {
 	}
 }
 
+// ErrConcurrentModification is returned by a Strict Enumerator if its tree
+// was mutated by other means than the Enumerator itself.
+var ErrConcurrentModification = errors.New("concurrent modification of the tree")
+
+// Enumerator modes, see Enumerator.SetMode.
+const (
+	// Resync is the default Enumerator mode. After the tree is mutated,
+	// the enumeration continues at the item following the last returned
+	// one.
+	Resync EnumeratorMode = iota
+
+	// Strict makes the Enumerator return ErrConcurrentModification after
+	// the tree is mutated, including setting the value of an existing key.
+	// The mutations made by the Enumerator's own Delete and SetValue are
+	// not concurrent ones.
+	Strict
+
+	// Snapshot makes the Enumerator enumerate the items as they were at
+	// the time of setting the mode, regardless of any later mutations of
+	// the tree. It costs a copy of all the tree pages.
+	Snapshot
+)
+
+// Kinds of differences, see Tree.Diff.
+const (
+	// DiffAdded is a key present only in the other tree.
+	DiffAdded DiffKind = iota
+
+	// DiffRemoved is a key present only in the tree.
+	DiffRemoved
+
+	// DiffChanged is a key present in both trees with different values.
+	DiffChanged
+)
+
+// Eviction policies, see Options.MaxItems.
+const (
+	// EvictSmallest evicts the item with the least key.
+	EvictSmallest EvictionPolicy = iota
+
+	// EvictLargest evicts the item with the greatest key.
+	EvictLargest
+
+	// EvictLRU evicts the least recently used item. Get, Put and Set
+	// use the item of their key. The order of use is kept in a list
+	// indexed by a second tree, Get updates the list and so it mutates
+	// the tree.
+	EvictLRU
+)
+
+// Tree mutations, see Observer.
+const (
+	// OpInsert is setting the value of a new key.
+	OpInsert Op = iota
+
+	// OpUpdate is setting the value of an existing key.
+	OpUpdate
+
+	// OpDelete is removing a key.
+	OpDelete
+
+	// OpClear is removing all keys of a non empty tree by Clear or
+	// Close. The key and the values passed to the Observer are zero
+	// values.
+	OpClear
+)
+
 var (
 	btDPool = sync.Pool{New: func() interface{} { return &d{} }}
 	btEPool = btEpool{sync.Pool{New: func() interface{} { return &Enumerator{} }}}
@@ -44,24 +117,37 @@ type btEpool struct{ sync.Pool }
 
 func (p *btEpool) get(err error, hit bool, i int, k interface{} /*K*/, q *d, t *Tree, ver int64) *Enumerator {
 	x := p.Get().(*Enumerator)
-	x.err, x.hit, x.i, x.k, x.q, x.t, x.ver = err, hit, i, k, q, t, ver
+	x.err, x.hit, x.i, x.k, x.mod, x.q, x.t, x.ver = err, hit, i, k, t.mod, q, t, ver
 	return x
 }
 
 type (
+	// Change is a mutation of a tree as passed to an Observer.
+	Change struct {
+		Op  Op
+		K   interface{} /*K*/
+		Old interface{} /*V*/
+		New interface{} /*V*/
+	}
+
 	// Cmp compares a and b. Return value is:
 	//
 	//	< 0 if a <  b
 	//	  0 if a == b
 	//	> 0 if a >  b
 	//
+	// Ints, Strings, Bytes and Time are Cmps of keys of the respective
+	// types, Reverse, Tuple, NilsFirst and NilsLast build Cmps from
+	// other Cmps.
 	Cmp func(a, b interface{} /*K*/) int
 
 	d struct { // data page
-		c int
-		d [2*kd + 1]de
-		n *d
-		p *d
+		a   interface{} // aggregate, see Monoid
+		c   int
+		d   [2*kd + 1]de
+		n   *d
+		p   *d
+		pfx string // common prefix of the keys omitted in d, see Tree.compress
 	}
 
 	de struct { // d element
@@ -69,6 +155,188 @@ type (
 		v interface{} /*V*/
 	}
 
+	// finger is a position in a tree, see walk. The keys in q are < hi,
+	// if hasHi. p is the parent of q and q is p.x[pi].ch.
+	finger struct {
+		hasHi bool
+		hi    interface{} /*K*/
+		p     *x
+		pi    int
+		q     *d
+	}
+
+	// Difference describes a key which differs between two trees, see
+	// Tree.Diff.
+	Difference struct {
+		Kind DiffKind
+		K    interface{} /*K*/
+		Old  interface{} /*V*/ // Valid for DiffChanged and DiffRemoved.
+		New  interface{} /*V*/ // Valid for DiffAdded and DiffChanged.
+	}
+
+	// DiffKind tells how a key differs between two trees.
+	DiffKind int
+
+	// EvictionPolicy selects the items evicted from a tree bounded by
+	// Options.MaxItems.
+	EvictionPolicy int
+
+	// Hasher returns the hash of an item, see Options.Hasher. Equal items
+	// must have equal hashes in all the trees which are compared by their
+	// hashes.
+	Hasher func(k interface{} /*K*/, v interface{} /*V*/) uint64
+
+	// Item is a KV pair.
+	Item struct {
+		K interface{} /*K*/
+		V interface{} /*V*/
+	}
+
+	// Mutation is an operation of ApplySorted. It deletes K if Delete is
+	// true, otherwise it sets the value of K to V.
+	Mutation struct {
+		Delete bool
+		K      interface{} /*K*/
+		V      interface{} /*V*/
+	}
+
+	// Monoid defines an aggregate of items which an augmented tree keeps
+	// for every page. Combine must be associative and Zero must be its
+	// identity element. FromItem maps a single item to its aggregate.
+	//
+	// For example, to answer range sums of int values
+	//
+	//	&Monoid{
+	//		Zero:     0,
+	//		FromItem: func(k, v interface{}) interface{} { return v },
+	//		Combine:  func(a, b interface{}) interface{} { return a.(int) + b.(int) },
+	//	}
+	//
+	// Count, if not nil, returns the number of items of an aggregate. It
+	// makes EstimateRange exact.
+	Monoid struct {
+		Zero     interface{}
+		FromItem func(k interface{} /*K*/, v interface{} /*V*/) interface{}
+		Combine  func(a, b interface{}) interface{}
+		Count    func(a interface{}) int
+	}
+
+	// Observer is called after every mutation of a tree it's set for, see
+	// Tree.SetObserver. The arguments not applicable to op are zero
+	// values. An Observer must not mutate the tree.
+	Observer func(op Op, k interface{} /*K*/, oldV, newV interface{} /*V*/)
+
+	// Op is the kind of a tree mutation, see Observer.
+	Op int
+
+	// Options amend the behavior of a Tree created by TreeNewOptions. The
+	// zero value of every field keeps the behavior of TreeNew.
+	Options struct {
+		// Monoid, if not nil, makes the tree augmented. Augmented
+		// trees support Aggregate and AggregateAll at the price of
+		// updating the aggregates on every mutation.
+		Monoid *Monoid
+
+		// PrefixSuccessor, if not nil, enables SeekPrefix and
+		// ScanPrefix for keys of any type.
+		PrefixSuccessor PrefixSuccessor
+
+		// Hasher, if not nil, makes the tree keep a hash of the items
+		// of every page, enabling RootHash and RangeHash. The hashes
+		// are updated on every mutation, like the aggregates of a
+		// Monoid, which can be used together with Hasher.
+		Hasher Hasher
+
+		// MaxItems, if positive, bounds the number of items in the
+		// tree. Setting a new key when the tree is full evicts an
+		// item selected by Evict. ApplySorted and BuildParallel evict
+		// the items once all their mutations are performed.
+		MaxItems int
+
+		// MaxBytes, if positive, bounds the size of the tree as
+		// reported by Tree.Bytes. Setting a key when the tree is over
+		// the bound evicts items selected by Evict until it's not.
+		MaxBytes int
+
+		// Evict is the eviction policy of a tree bounded by MaxItems
+		// or MaxBytes.
+		Evict EvictionPolicy
+
+		// OnEvict, if not nil, is called with every evicted item,
+		// after the item is removed from the tree.
+		OnEvict func(k interface{} /*K*/, v interface{} /*V*/)
+
+		// Sizer, if not nil, is used to keep the total size of the
+		// items of the tree, see Tree.Bytes.
+		Sizer Sizer
+
+		// Seed, if not zero, seeds the random source used by
+		// Tree.RandomItem and Tree.Sample when they're passed a nil
+		// rng. Trees having the same Seed, mutated in the same way,
+		// then produce the same random items, which makes eg. tests
+		// reproducible. Clones of the tree start their random source
+		// afresh from Seed. Concurrent calls draw from the random
+		// source in an unspecified order.
+		Seed int64
+	}
+
+	// Partition is the range of keys [Lo, Hi) of a tree, as returned by
+	// Tree.Partitions. The last partition of a tree has no Hi bound.
+	Partition struct {
+		Count int         // Estimated number of items in the range.
+		HasHi bool        // Whether Hi bounds the range.
+		Hi    interface{} /*K*/ // Valid if HasHi.
+		Lo    interface{} /*K*/
+		t     *Tree
+	}
+
+	pe struct { // path element, see Enumerator.SeekFrom
+		hasHi bool
+		hasLo bool
+		hi    interface{} /*K*/ // valid if hasHi
+		i     int         // index of the child of x on the path
+		lo    interface{} /*K*/ // valid if hasLo
+		x     *x          // the keys of x.x[i].ch are in [lo, hi)
+	}
+
+	// PrefixSuccessor returns the least key greater than all keys having
+	// the prefix p, or (whatever, false) if there's no such key. The
+	// prefix itself is assumed to be the least key having the prefix p.
+	//
+	// For example, the successor of the path "/usr/" in a tree of
+	// slash separated paths is "/usr0", the successor of the byte string
+	// "ab\xff" is "ac" and the byte string "\xff\xff" has no successor.
+	PrefixSuccessor func(p interface{} /*K*/) (succ interface{} /*K*/, ok bool)
+
+	// Cursor is a bidirectional iterator over the items of a tree. Unlike
+	// an Enumerator, a Cursor moves and returns the current item by
+	// separate methods.
+	//
+	//	for ok := c.Seek(k); ok; ok = c.Next() {
+	//		use(c.Key(), c.Value())
+	//	}
+	//	if err := c.Err(); err != nil {
+	//		...
+	//	}
+	//
+	// A Cursor handles mutations of its tree according to its mode, see
+	// SetMode. In the default Resync mode the cursor stays on its item, if
+	// the item still exists. Otherwise the cursor becomes invalid, but it
+	// can still move to the neighbors of the removed item.
+	Cursor struct {
+		err  error
+		i    int
+		k    interface{} /*K*/ // key of the current or removed item
+		mod  int64       // t.mod when positioned
+		mode EnumeratorMode
+		ok   bool // positioned on the item with key k
+		q    *d
+		set  bool  // k is set and the cursor can move
+		src  *Tree // the iterated tree if t is its snapshot
+		t    *Tree
+		ver  int64 // -1: reposition, but not due to a mutation
+	}
+
 	// Enumerator captures the state of enumerating a tree. It is returned
 	// from the Seek* methods. The enumerator is aware of any mutations
 	// made to the tree in the process of enumerating it and automatically
@@ -78,23 +346,63 @@ type (
 	// items", it does no more attempt to "resync" on tree mutation(s).  In
 	// other words, io.EOF from an Enumerator is "sticky" (idempotent).
 	Enumerator struct {
-		err error
-		hit bool
-		i   int
-		k   interface{} /*K*/
-		q   *d
-		t   *Tree
-		ver int64
-	}
+		ci    int // index of the current item in cq
+		cq    *d  // page of the current item while ver == t.ver
+		err   error
+		hasHi bool
+		hasLo bool
+		hi    interface{} /*K*/
+		hit   bool
+		i     int
+		k     interface{} /*K*/
+		lo    interface{} /*K*/
+		mod   int64       // t.mod when positioned
+		mode  EnumeratorMode
+		path  []pe  // the index pages from the root to q if pver == t.ver
+		pver  int64 // t.ver when path was valid
+		q     *d
+		ret   bool  // k was returned by Next or Prev
+		src   *Tree // the enumerated tree if t is its snapshot
+		t     *Tree
+		ver   int64 // -1: reposition, but not due to a mutation
+	}
+
+	// EnumeratorMode determines how an Enumerator handles mutations of
+	// its tree.
+	EnumeratorMode int
+
+	// Sizer returns the size of an item in bytes, see Options.Sizer.
+	Sizer func(k interface{} /*K*/, v interface{} /*V*/) int
 
 	// Tree is a B+tree.
 	Tree struct {
-		c     int
-		cmp   Cmp
-		first *d
-		last  *d
-		r     interface{}
-		ver   int64
+		bytes    int // total size of the items by sizer
+		c        int
+		cmp      Cmp
+		compress bool // prefix compressed d pages, see TreeNewBytes
+		evict    EvictionPolicy
+		fastFind func(q interface{}, k interface{} /*K*/) (int, bool)
+		first    *d
+		hasher   Hasher
+		last     *d
+		lru      *lru
+		max      int
+		maxBytes int
+		mod      int64    // number of updates of existing values, see Strict
+		mon      *Monoid  // hashMonoid(umon) if hasher != nil
+		nd       int      // number of d pages
+		nx       int      // number of x pages
+		obs      Observer // uobs or t.observe, nil if there's nothing to observe
+		onEvict  func(k interface{} /*K*/, v interface{} /*V*/)
+		r        interface{}
+		rebal    bool       // items or pages moved between siblings
+		rng      *rand.Rand // see rand
+		seed     int64
+		sizer    Sizer
+		succ     PrefixSuccessor
+		umon     *Monoid  // Options.Monoid if hasher != nil
+		uobs     Observer // see SetObserver
+		ver      int64
 	}
 
 	xe struct { // x element
@@ -103,6 +411,7 @@ type (
 	}
 
 	x struct { // index page
+		a interface{} // aggregate, see Monoid
 		c int
 		x [2*kx + 2]xe
 	}
@@ -114,6 +423,7 @@ var ( // R/O zero values
 	ze  Enumerator
 	zk  interface{} /*K*/
 	zt  Tree
+	zv  interface{} /*V*/
 	zx  x
 	zxe xe
 )
@@ -132,6 +442,215 @@ func clr(q interface{}) {
 	}
 }
 
+type itemSorter struct {
+	a   []Item
+	cmp Cmp
+}
+
+func (s itemSorter) Len() int           { return len(s.a) }
+func (s itemSorter) Less(i, j int) bool { return s.cmp(s.a[i].K, s.a[j].K) < 0 }
+func (s itemSorter) Swap(i, j int)      { s.a[i], s.a[j] = s.a[j], s.a[i] }
+
+// ----------------------------------------------------------------------- lru
+
+// lru is a list of keys in the order of their use, most recent first. The list
+// elements are indexed by their keys in a treap.
+type lru struct {
+	cmp  Cmp
+	rnd  uint32
+	root lruElem // list sentinel
+	t    *lruElem
+}
+
+type lruElem struct {
+	k          interface{} /*K*/
+	l, r       *lruElem    // treap children
+	next, prev *lruElem
+	prio       uint32
+}
+
+func newLRU(cmp Cmp) *lru {
+	l := &lru{cmp: cmp, rnd: 1}
+	l.root.next, l.root.prev = &l.root, &l.root
+	return l
+}
+
+// back returns the least recently used key, or ok == false if l is empty.
+func (l *lru) back() (k interface{} /*K*/, ok bool) {
+	if e := l.root.prev; e != &l.root {
+		return e.k, true
+	}
+
+	return k, false
+}
+
+func (l *lru) find(k interface{} /*K*/) *lruElem {
+	for e := l.t; e != nil; {
+		switch c := l.cmp(k, e.k); {
+		case c < 0:
+			e = e.l
+		case c > 0:
+			e = e.r
+		default:
+			return e
+		}
+	}
+	return nil
+}
+
+func (l *lru) insert(t, e *lruElem) *lruElem {
+	if t == nil {
+		return e
+	}
+
+	if l.cmp(e.k, t.k) < 0 {
+		if t.l = l.insert(t.l, e); t.l.prio > t.prio {
+			u := t.l
+			t.l, u.r = u.r, t
+			return u
+		}
+		return t
+	}
+
+	if t.r = l.insert(t.r, e); t.r.prio > t.prio {
+		u := t.r
+		t.r, u.l = u.l, t
+		return u
+	}
+	return t
+}
+
+// join returns the treap of the items of a followed by the items of b.
+func (l *lru) join(a, b *lruElem) *lruElem {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case a.prio > b.prio:
+		a.r = l.join(a.r, b)
+		return a
+	default:
+		b.l = l.join(a, b.l)
+		return b
+	}
+}
+
+// delete removes the existing k from the treap t.
+func (l *lru) delete(t *lruElem, k interface{} /*K*/) *lruElem {
+	switch c := l.cmp(k, t.k); {
+	case c < 0:
+		t.l = l.delete(t.l, k)
+	case c > 0:
+		t.r = l.delete(t.r, k)
+	default:
+		return l.join(t.l, t.r)
+	}
+	return t
+}
+
+func (l *lru) pushFront(e *lruElem) {
+	e.prev, e.next = &l.root, l.root.next
+	e.prev.next, e.next.prev = e, e
+}
+
+func (l *lru) remove(e *lruElem) {
+	e.prev.next, e.next.prev = e.next, e.prev
+	e.next, e.prev = nil, nil
+}
+
+// touch moves k to the front of l.
+func (l *lru) touch(k interface{} /*K*/) {
+	if e := l.find(k); e != nil {
+		l.remove(e)
+		l.pushFront(e)
+	}
+}
+
+// update updates l after a mutation of its tree.
+func (l *lru) update(op Op, k interface{} /*K*/) {
+	switch op {
+	case OpInsert:
+		l.rnd ^= l.rnd << 13 // xorshift32
+		l.rnd ^= l.rnd >> 17
+		l.rnd ^= l.rnd << 5
+		e := &lruElem{k: k, prio: l.rnd}
+		l.t = l.insert(l.t, e)
+		l.pushFront(e)
+	case OpUpdate:
+		l.touch(k)
+	case OpDelete:
+		if e := l.find(k); e != nil {
+			l.t = l.delete(l.t, k)
+			l.remove(e)
+		}
+	case OpClear:
+		l.t = nil
+		l.root.next, l.root.prev = &l.root, &l.root
+	}
+}
+
+// ---------------------------------------------------------------------- hash
+
+// The hash of the items i0, ..., in-1 is the polynomial
+//
+//	(h(i0) mod (P-1) + 1)*B^(n-1) + ... + (h(in-1) mod (P-1) + 1)*B^0 mod P
+//
+// where h is the Hasher of the tree. Hashes of adjacent item ranges combine
+// associatively given B^n of the right range, so the hash of a range does not
+// depend on the pages the items are spread over.
+const (
+	hashB = 0x1b873593cc9e2d51 % hashP
+	hashP = 1<<61 - 1
+)
+
+type hashAggregate struct {
+	a interface{} // aggregate of the user's Monoid, if any
+	h uint64      // hash of the items
+	p uint64      // hashB^n
+}
+
+// hashMonoid returns a Monoid maintaining hashes of items by h along with the
+// aggregates of m, which may be nil.
+func hashMonoid(m *Monoid, h Hasher) *Monoid {
+	r := &Monoid{
+		Zero: hashAggregate{p: 1},
+		FromItem: func(k interface{} /*K*/, v interface{} /*V*/) interface{} {
+			a := hashAggregate{h: h(k, v)%(hashP-1) + 1, p: hashB}
+			if m != nil {
+				a.a = m.FromItem(k, v)
+			}
+			return a
+		},
+		Combine: func(a, b interface{}) interface{} {
+			x, y := a.(hashAggregate), b.(hashAggregate)
+			r := hashAggregate{h: hashMod(hashMul(x.h, y.p) + y.h), p: hashMul(x.p, y.p)}
+			if m != nil {
+				r.a = m.Combine(x.a, y.a)
+			}
+			return r
+		},
+	}
+	if m != nil {
+		r.Zero = hashAggregate{a: m.Zero, p: 1}
+	}
+	return r
+}
+
+// hashMod returns a mod hashP for a < 2*hashP.
+func hashMod(a uint64) uint64 {
+	if a >= hashP {
+		a -= hashP
+	}
+	return a
+}
+
+// hashMul returns a*b mod hashP for a, b <= hashP.
+func hashMul(a, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	return hashMod(hashMod(hi<<3|lo>>61) + lo&hashP)
+}
+
 // -------------------------------------------------------------------------- x
 
 func newX(ch0 interface{}) *x {
@@ -192,128 +711,745 @@ func (l *d) mvR(r *d, c int) {
 	l.c -= c
 }
 
+// fwd returns the position of the item i of q, or of the first item of q.n if
+// i == q.c.
+func fwd(q *d, i int) (*d, int) {
+	if q != nil && i >= q.c {
+		q, i = q.n, 0
+	}
+	return q, i
+}
+
+// back returns the position of the item i of q, or of the last item of q.p if
+// i < 0.
+func back(q *d, i int) (*d, int) {
+	if q != nil && i < 0 {
+		if q = q.p; q != nil {
+			i = q.c - 1
+		}
+	}
+	return q, i
+}
+
+// item returns the item at index i of q. An index out of range of q denotes
+// the first item of q.n if i == q.c or the last item of q.p if i < 0.
+func (t *Tree) item(q *d, i int) (k interface{} /*K*/, v interface{} /*V*/, ok bool) {
+	if i < 0 {
+		q, i = back(q, i)
+	} else {
+		q, i = fwd(q, i)
+	}
+	if q == nil {
+		return
+	}
+
+	return t.key(q, i), q.d[i].v, true
+}
+
 // ----------------------------------------------------------------------- Tree
 
+// ChanObserver returns an Observer sending the mutations to c. The Observer
+// blocks the mutating method while c is full, use a buffered channel to avoid
+// that.
+func ChanObserver(c chan<- Change) Observer {
+	return func(op Op, k interface{} /*K*/, oldV, newV interface{} /*V*/) {
+		c <- Change{op, k, oldV, newV}
+	}
+}
+
 // TreeNew returns a newly created, empty Tree. The compare function is used
 // for key collation.
 func TreeNew(cmp Cmp) *Tree {
 	return btTPool.get(cmp)
 }
 
-// Clear removes all K/V pairs from the tree.
-func (t *Tree) Clear() {
-	if t.r == nil {
-		return
+// TreeNewOptions returns a newly created, empty Tree amended by o, which may
+// be nil. The compare function is used for key collation.
+func TreeNewOptions(cmp Cmp, o *Options) *Tree {
+	t := btTPool.get(cmp)
+	if o != nil {
+		if o.Monoid != nil {
+			m := *o.Monoid
+			t.mon = &m
+		}
+		t.succ = o.PrefixSuccessor
+		if o.Hasher != nil {
+			t.hasher, t.umon = o.Hasher, t.mon
+			t.mon = hashMonoid(t.umon, t.hasher)
+		}
+		if o.MaxItems > 0 || o.MaxBytes > 0 {
+			t.evict, t.max, t.maxBytes, t.onEvict = o.Evict, o.MaxItems, o.MaxBytes, o.OnEvict
+			if t.evict == EvictLRU {
+				t.lru = newLRU(cmp)
+			}
+		}
+		t.seed, t.sizer = o.Seed, o.Sizer
+		t.hook()
 	}
+	return t
+}
 
-	clr(t.r)
-	t.c, t.first, t.last, t.r = 0, nil, nil, nil
-	t.ver++
+// Aggregate returns the aggregate of the items having keys in [lo, hi),
+// computed in O(log n). Aggregate returns the Zero of the tree's Monoid if the
+// range is empty. It panics if the tree is not augmented, see Options.Monoid.
+func (t *Tree) Aggregate(lo, hi interface{} /*K*/) interface{} {
+	if t.cmp(lo, hi) >= 0 || t.r == nil {
+		return t.userAggregate(t.mon.Zero)
+	}
+
+	return t.userAggregate(t.aggregate(t.r, lo, hi, true, true))
 }
 
-// Close performs Clear and recycles t to a pool for possible later reuse. No
-// references to t should exist or such references must not be used afterwards.
-func (t *Tree) Close() {
-	t.Clear()
-	*t = zt
-	btTPool.Put(t)
+func (t *Tree) aggregate(q interface{}, lo, hi interface{} /*K*/, hasLo, hasHi bool) interface{} {
+	m := t.mon
+	switch x := q.(type) {
+	case *x:
+		if !hasLo && !hasHi {
+			return x.a
+		}
+
+		l, h := 0, x.c
+		if hasLo {
+			l = t.child(x, lo)
+		}
+		if hasHi {
+			h = t.child(x, hi)
+		}
+		if l == h {
+			return t.aggregate(x.x[l].ch, lo, hi, hasLo, hasHi)
+		}
+
+		a := t.aggregate(x.x[l].ch, lo, hi, hasLo, false)
+		for i := l + 1; i < h; i++ {
+			a = m.Combine(a, aggregate(x.x[i].ch))
+		}
+		return m.Combine(a, t.aggregate(x.x[h].ch, lo, hi, false, hasHi))
+	case *d:
+		if !hasLo && !hasHi {
+			return x.a
+		}
+
+		l, h := 0, x.c
+		if hasLo {
+			l, _ = t.find(x, lo)
+		}
+		if hasHi {
+			h, _ = t.find(x, hi)
+		}
+		a := m.Zero
+		for i := l; i < h; i++ {
+			a = m.Combine(a, m.FromItem(t.key(x, i), x.d[i].v))
+		}
+		return a
+	}
+	panic("internal error")
 }
 
-func (t *Tree) cat(p *x, q, r *d, pi int) {
-	t.ver++
-	q.mvL(r, r.c)
-	if r.n != nil {
-		r.n.p = q
-	} else {
-		t.last = q
+// AggregateAll returns the aggregate of all items in the tree. It panics if
+// the tree is not augmented, see Options.Monoid.
+func (t *Tree) AggregateAll() interface{} {
+	if t.r == nil {
+		return t.userAggregate(t.mon.Zero)
 	}
-	q.n = r.n
-	*r = zd
-	btDPool.Put(r)
-	if p.c > 1 {
-		p.extract(pi)
-		p.x[pi].ch = q
-		return
+
+	return t.userAggregate(aggregate(t.r))
+}
+
+// userAggregate returns the part of the aggregate a computed by the Monoid of
+// the tree.
+func (t *Tree) userAggregate(a interface{}) interface{} {
+	if t.hasher == nil {
+		return a
 	}
 
-	switch x := t.r.(type) {
+	if t.umon == nil {
+		panic("b: tree is not augmented")
+	}
+
+	return a.(hashAggregate).a
+}
+
+// userMonoid returns the Monoid of the tree's Options, if any.
+func (t *Tree) userMonoid() *Monoid {
+	if t.hasher != nil {
+		return t.umon
+	}
+
+	return t.mon
+}
+
+func aggregate(q interface{}) interface{} {
+	switch x := q.(type) {
 	case *x:
-		*x = zx
-		btXPool.Put(x)
+		return x.a
 	case *d:
-		*x = zd
-		btDPool.Put(x)
+		return x.a
 	}
-	t.r = q
+	panic("internal error")
 }
 
-func (t *Tree) catX(p, q, r *x, pi int) {
-	t.ver++
-	q.x[q.c].k = p.x[pi].k
-	copy(q.x[q.c+1:], r.x[:r.c])
-	q.c += r.c + 1
-	q.x[q.c].ch = r.x[r.c].ch
-	*r = zx
-	btXPool.Put(r)
-	if p.c > 1 {
-		p.c--
-		pc := p.c
-		if pi < pc {
-			p.x[pi].k = p.x[pi+1].k
-			copy(p.x[pi+1:], p.x[pi+2:pc+1])
-			p.x[pc].ch = p.x[pc+1].ch
-			p.x[pc].k = zk     // GC
-			p.x[pc+1].ch = nil // GC
+// augment updates the aggregates of the pages on the path to k. Siblings of
+// those pages are updated as well if the mutation moved items or pages between
+// them.
+func (t *Tree) augment(k interface{} /*K*/) {
+	if t.r != nil {
+		t.augmentPath(t.r, k, t.rebal)
+	}
+	t.rebal = false
+}
+
+func (t *Tree) augmentPath(q interface{}, k interface{} /*K*/, sibs bool) {
+	if x, ok := q.(*x); ok {
+		i := t.child(x, k)
+		t.augmentPath(x.x[i].ch, k, sibs)
+		if sibs {
+			if i > 0 {
+				t.augmentPage(x.x[i-1].ch)
+			}
+			if i < x.c {
+				t.augmentPage(x.x[i+1].ch)
+			}
 		}
-		return
 	}
+	t.augmentPage(q)
+}
 
-	switch x := t.r.(type) {
+func (t *Tree) augmentPage(q interface{}) {
+	m := t.mon
+	a := m.Zero
+	switch x := q.(type) {
 	case *x:
-		*x = zx
-		btXPool.Put(x)
+		for i := 0; i <= x.c; i++ {
+			a = m.Combine(a, aggregate(x.x[i].ch))
+		}
+		x.a = a
 	case *d:
-		*x = zd
-		btDPool.Put(x)
+		for i := 0; i < x.c; i++ {
+			a = m.Combine(a, m.FromItem(t.key(x, i), x.d[i].v))
+		}
+		x.a = a
 	}
-	t.r = q
 }
 
-// Delete removes the k's KV pair, if it exists, in which case Delete returns
-// true.
-func (t *Tree) Delete(k interface{} /*K*/) (ok bool) {
-	pi := -1
-	var p *x
-	q := t.r
-	if q == nil {
-		return false
+// child returns the index of the child of q where k belongs.
+func (t *Tree) child(q *x, k interface{} /*K*/) int {
+	i, ok := t.find(q, k)
+	if ok {
+		i++
 	}
+	return i
+}
+
+// Bytes returns the total size of the items of t, as reported by the Sizer of
+// t, plus the size of the tree pages. Without a Sizer, only the pages are
+// counted.
+func (t *Tree) Bytes() int {
+	return t.bytes + t.nd*int(unsafe.Sizeof(d{})) + t.nx*int(unsafe.Sizeof(x{})) + int(unsafe.Sizeof(Tree{}))
+}
+
+// ApplySorted performs ops in order, with the same result as calling Set or
+// Delete for every one of them. ApplySorted is much faster if the keys of ops
+// are sorted in the key collating order: while the keys of consecutive ops
+// fall to the same data page, the page is not looked up again and it's
+// mutated in place as long as it does not overflow or underflow. The index
+// pages, including their aggregates, are updated once per such page.
+// Unsorted ops are performed correctly, but slower.
+func (t *Tree) ApplySorted(ops []Mutation) {
+	var changes []Change
+	var dirty bool // f.q or the index was changed
+	var f finger
+	// dk is a key in f.q, prev is the key of the previous op in f.q.
+	var dk, prev interface{} /*K*/
+	leave := func() {
+		if dirty && t.mon != nil {
+			t.augment(dk)
+		}
+		dirty, f = false, finger{}
+	}
+	for _, op := range ops {
+		k := op.K
+		if f.q != nil && (t.cmp(k, prev) < 0 || f.hasHi && t.cmp(k, f.hi) >= 0) {
+			leave()
+		}
 
-	for {
 		var i int
-		i, ok = t.find(q, k)
-		if ok {
-			switch x := q.(type) {
-			case *x:
-				if x.c < kx && q != t.r {
-					x, i = t.underflowX(p, x, pi, i)
-				}
-				pi = i + 1
+		var ok bool
+		if f.q == nil {
+			f, i, ok = t.walk(k) // May split index pages.
+			dirty, dk = true, k
+		} else {
+			i, ok = t.find(f.q, k)
+		}
+		prev = k
+		q := f.q
+		var ch Change
+		switch {
+		case op.Delete:
+			if !ok {
+				continue
+			}
+
+			ch = Change{OpDelete, k, q.d[i].v, zv}
+			switch {
+			case q.c > kd || q == t.r:
+				t.extract(q, i)
+				if t.c == 0 {
+					t.clear()
+					dirty, f = false, finger{}
+				}
+			default:
+				leave()
+				t.delete(k, nil, nil, zv)
+			}
+		case ok:
+			ch = Change{OpUpdate, k, q.d[i].v, op.V}
+			q.d[i].v = op.V
+			t.mod++
+		case q != nil && q.c < 2*kd:
+			ch = Change{OpInsert, k, zv, op.V}
+			t.insert(q, i, k, op.V)
+		default:
+			ch = Change{OpInsert, k, zv, op.V}
+			t.insertAt(f, i, k, op.V)
+			dirty, dk = true, k
+			leave()
+		}
+		if t.obs != nil {
+			changes = append(changes, ch)
+		}
+	}
+	leave()
+	if t.obs != nil {
+		t.observeAll(changes)
+	}
+}
+
+// Ceiling returns the item with the least key >= k. If there's no such item,
+// ok is false.
+func (t *Tree) Ceiling(k interface{} /*K*/) (ck interface{} /*K*/, v interface{} /*V*/, ok bool) {
+	q, i, _ := t.locate(k)
+	return t.item(q, i)
+}
+
+// Clear removes all K/V pairs from the tree.
+func (t *Tree) Clear() {
+	if t.r == nil {
+		return
+	}
+
+	t.clear()
+	if t.obs != nil {
+		t.obs(OpClear, zk, zv, zv)
+	}
+}
+
+func (t *Tree) clear() {
+	clr(t.r)
+	t.c, t.first, t.last, t.r = 0, nil, nil, nil
+	t.nd, t.nx = 0, 0
+	t.ver++
+}
+
+// Close performs Clear and recycles t to a pool for possible later reuse. No
+// references to t should exist or such references must not be used afterwards.
+func (t *Tree) Close() {
+	t.Clear()
+	*t = zt
+	btTPool.Put(t)
+}
+
+// Clone returns a copy of t having the same shape and content. If cloneValue
+// is not nil, the values in the copy are the results of cloneValue called for
+// the values of t, in key order. Otherwise the values are copied as is.
+//
+// Clone copies the pages of t directly, it's much faster than setting all the
+// items of t in a new Tree. The copy has no Observer and it's not bounded by
+// Options.{MaxBytes,MaxItems}. The copy uses the Sizer of t, if any.
+func (t *Tree) Clone(cloneValue func(v interface{} /*V*/) interface{} /*V*/) *Tree {
+	return t.clone(cloneValue)
+}
+
+// clone returns a copy of t having the same shape as t.
+func (t *Tree) clone(cloneValue func(interface{} /*V*/) interface{} /*V*/) *Tree {
+	c := btTPool.get(t.cmp)
+	c.c, c.fastFind, c.mon, c.succ = t.c, t.fastFind, t.mon, t.succ
+	c.compress, c.hasher, c.nd, c.nx, c.umon = t.compress, t.hasher, t.nd, t.nx, t.umon
+	c.bytes, c.seed, c.sizer = t.bytes, t.seed, t.sizer
+	c.hook()
+	if t.r == nil {
+		return c
+	}
+
+	var f func(interface{}) interface{}
+	f = func(q interface{}) interface{} {
+		switch p := q.(type) {
+		case *x:
+			y := btXPool.Get().(*x)
+			*y = *p
+			for i := 0; i <= p.c; i++ {
+				y.x[i].ch = f(p.x[i].ch)
+			}
+			return y
+		case *d:
+			y := btDPool.Get().(*d)
+			*y = *p
+			y.n, y.p = nil, c.last
+			if cloneValue != nil {
+				for i := range y.d[:y.c] {
+					y.d[i].v = cloneValue(y.d[i].v)
+				}
+			}
+			if c.last != nil {
+				c.last.n = y
+			} else {
+				c.first = y
+			}
+			c.last = y
+			return y
+		}
+		panic("internal error")
+	}
+	c.r = f(t.r)
+	if c.sizer != nil && cloneValue != nil {
+		c.bytes = 0
+		for q := c.first; q != nil; q = q.n {
+			for i, it := range q.d[:q.c] {
+				c.bytes += c.sizer(c.key(q, i), it.v)
+			}
+		}
+	}
+	return c
+}
+
+// BuildParallel sets the values associated with the keys of items, as if
+// calling Set for every item in order, but much faster for a large number of
+// items. The items are sorted in chunks by up to workers goroutines, or by
+// runtime.GOMAXPROCS(0) of them if workers < 1, then the sorted chunks are
+// merged in parallel and the tree pages are built bottom up from the result.
+// The compare function of t must be safe for concurrent use.
+//
+// An Observer of t is called once for every distinct key of items, after all
+// the items are set.
+//
+// BuildParallel reorders items, if t is empty. Otherwise items are not
+// modified. In addition to the pages of the tree, BuildParallel allocates a
+// merge buffer of t.Len()+len(items) Items and, if t is not empty, another one
+// of the same size holding copies of the existing items and of items.
+func (t *Tree) BuildParallel(items []Item, workers int) {
+	if len(items) == 0 {
+		return
+	}
+
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if n := len(items) / (2 * kd); workers > n {
+		workers = n
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	all, base := items, 0
+	if t.c != 0 {
+		all = make([]Item, 0, t.c+len(items))
+		for q := t.first; q != nil; q = q.n {
+			for i, it := range q.d[:q.c] {
+				all = append(all, Item{t.key(q, i), it.v})
+			}
+		}
+		base = len(all)
+		all = append(all, items...)
+	}
+
+	runs := []int{0}
+	if base != 0 {
+		runs = append(runs, base)
+	}
+	var wg sync.WaitGroup
+	chunk := (len(items) + workers - 1) / workers
+	for lo := base; lo < len(all); lo += chunk {
+		hi := lo + chunk
+		if hi > len(all) {
+			hi = len(all)
+		}
+		wg.Add(1)
+		go func(a []Item) {
+			defer wg.Done()
+			sort.Stable(itemSorter{a, t.cmp})
+		}(all[lo:hi])
+		runs = append(runs, hi)
+	}
+	wg.Wait()
+
+	buf := make([]Item, len(all))
+	src, dst := all, buf
+	for len(runs) > 2 {
+		var next []int
+		for i := 0; i+1 < len(runs); i += 2 {
+			lo, mid, hi := runs[i], runs[i+1], runs[i+1]
+			if i+2 < len(runs) {
+				hi = runs[i+2]
+			}
+			wg.Add(1)
+			go func(lo, mid, hi int) {
+				defer wg.Done()
+				t.merge(dst[lo:hi], src[lo:mid], src[mid:hi])
+			}(lo, mid, hi)
+			next = append(next, lo)
+		}
+		next = append(next, len(all))
+		wg.Wait()
+		runs, src, dst = next, dst, src
+	}
+
+	// Keep the last one of equal keys. The result goes to buf, which is
+	// either src or free, so items are only reordered.
+	n := 0
+	for i, it := range src {
+		if i+1 < len(src) && t.cmp(it.K, src[i+1].K) == 0 {
+			continue
+		}
+
+		buf[n] = it
+		n++
+	}
+	var old []Change
+	if t.obs != nil {
+		old = make([]Change, n)
+		for i, it := range buf[:n] {
+			c := &old[i]
+			c.Op, c.K, c.New = OpInsert, it.K, it.V
+			if q, i, ok := t.locate(it.K); ok {
+				c.Op, c.Old = OpUpdate, q.d[i].v
+			}
+		}
+	}
+	if t.r != nil {
+		clr(t.r)
+	}
+	t.build(buf[:n])
+	if t.obs != nil {
+		t.observeAll(old)
+	}
+	for i := range buf {
+		buf[i] = Item{} // GC
+	}
+	if base != 0 {
+		for i := range all {
+			all[i] = Item{} // GC
+		}
+	}
+}
+
+// build replaces the content of t by items, which must be sorted and unique.
+// The pages of t must be already recycled.
+func (t *Tree) build(items []Item) {
+	t.ver++
+	t.c, t.first, t.last, t.r = len(items), nil, nil, nil
+	t.nd, t.nx = 0, 0
+	if len(items) == 0 {
+		return
+	}
+
+	n := len(items)
+	leaves := make([]*d, (n+2*kd-1)/(2*kd))
+	for i := range leaves {
+		lo, hi := i*n/len(leaves), (i+1)*n/len(leaves)
+		q := btDPool.Get().(*d)
+		t.nd++
+		for j, it := range items[lo:hi] {
+			q.d[j] = de{it.K, it.V}
+		}
+		q.c = hi - lo
+		t.encode(q, 0, q.c, "")
+		if q.p = t.last; q.p != nil {
+			q.p.n = q
+		} else {
+			t.first = q
+		}
+		t.last = q
+		leaves[i] = q
+	}
+	t.buildIndex(leaves)
+}
+
+// buildIndex builds the index pages of t over its data pages and sets t.r.
+func (t *Tree) buildIndex(leaves []*d) {
+	level := make([]interface{}, len(leaves))
+	keys := make([]interface{} /*K*/, len(leaves))
+	for i, q := range leaves {
+		level[i], keys[i] = q, t.key(q, 0)
+		if t.mon != nil {
+			t.augmentPage(q)
+		}
+	}
+	for m := len(level); m > 1; m = len(level) {
+		n := (m + 2*kx) / (2*kx + 1)
+		for i := 0; i < n; i++ {
+			lo, hi := i*m/n, (i+1)*m/n
+			q := btXPool.Get().(*x)
+			t.nx++
+			for j := lo; j < hi; j++ {
+				q.x[j-lo].ch = level[j]
+				if j > lo {
+					q.x[j-lo-1].k = keys[j]
+				}
+			}
+			q.c = hi - lo - 1
+			if t.mon != nil {
+				t.augmentPage(q)
+			}
+			level[i], keys[i] = q, keys[lo]
+		}
+		level, keys = level[:n], keys[:n]
+	}
+	t.r = level[0]
+}
+
+// merge merges the sorted a and b to dst. Items of a precede equal items of
+// b.
+func (t *Tree) merge(dst, a, b []Item) {
+	for len(a) != 0 && len(b) != 0 {
+		if t.cmp(b[0].K, a[0].K) < 0 {
+			dst[0], b = b[0], b[1:]
+		} else {
+			dst[0], a = a[0], a[1:]
+		}
+		dst = dst[1:]
+	}
+	copy(dst[copy(dst, a):], b)
+}
+
+func (t *Tree) cat(p *x, q, r *d, pi int) {
+	t.ver++
+	t.rebal = true
+	t.mvL(q, r, r.c)
+	if r.n != nil {
+		r.n.p = q
+	} else {
+		t.last = q
+	}
+	q.n = r.n
+	*r = zd
+	btDPool.Put(r)
+	t.nd--
+	if p.c > 1 {
+		p.extract(pi)
+		p.x[pi].ch = q
+		return
+	}
+
+	switch x := t.r.(type) {
+	case *x:
+		*x = zx
+		btXPool.Put(x)
+		t.nx--
+	case *d:
+		*x = zd
+		btDPool.Put(x)
+		t.nd--
+	}
+	t.r = q
+}
+
+func (t *Tree) catX(p, q, r *x, pi int) {
+	t.ver++
+	t.rebal = true
+	q.x[q.c].k = p.x[pi].k
+	copy(q.x[q.c+1:], r.x[:r.c])
+	q.c += r.c + 1
+	q.x[q.c].ch = r.x[r.c].ch
+	*r = zx
+	btXPool.Put(r)
+	t.nx--
+	if p.c > 1 {
+		p.c--
+		pc := p.c
+		if pi < pc {
+			p.x[pi].k = p.x[pi+1].k
+			copy(p.x[pi+1:], p.x[pi+2:pc+1])
+			p.x[pc].ch = p.x[pc+1].ch
+			p.x[pc].k = zk     // GC
+			p.x[pc+1].ch = nil // GC
+		}
+		return
+	}
+
+	switch x := t.r.(type) {
+	case *x:
+		*x = zx
+		btXPool.Put(x)
+		t.nx--
+	case *d:
+		*x = zd
+		btDPool.Put(x)
+		t.nd--
+	}
+	t.r = q
+}
+
+// Delete removes the k's KV pair, if it exists, in which case Delete returns
+// true.
+func (t *Tree) Delete(k interface{} /*K*/) (ok bool) {
+	if t.obs == nil {
+		_, ok = t.delete(k, nil, nil, zv)
+		return ok
+	}
+
+	var v interface{} /*V*/
+	if v, ok = t.delete(k, nil, nil, zv); ok {
+		t.obs(OpDelete, k, v, zv)
+	}
+	return ok
+}
+
+// delete removes the k's KV pair and returns its value, if it exists. If pred
+// is not nil, the KV pair is removed only if pred returns true for its value.
+// If eq is not nil, the KV pair is removed only if its value equals oldV
+// according to eq.
+func (t *Tree) delete(k interface{} /*K*/, pred func(interface{} /*V*/) bool, eq func(a, b interface{} /*V*/) bool, oldV interface{} /*V*/) (v interface{} /*V*/, ok bool) {
+	if t.mon != nil {
+		defer t.augment(k)
+	}
+
+	pi := -1
+	var p *x
+	q := t.r
+	if q == nil {
+		return v, false
+	}
+
+	for {
+		var i int
+		i, ok = t.find(q, k)
+		if ok {
+			switch x := q.(type) {
+			case *x:
+				if x.c < kx && q != t.r {
+					x, i = t.underflowX(p, x, pi, i)
+				}
+				pi = i + 1
 				p = x
 				q = x.x[pi].ch
 				continue
 			case *d:
+				v = x.d[i].v
+				if pred != nil && !pred(v) || eq != nil && !eq(v, oldV) {
+					return v, false
+				}
+
 				t.extract(x, i)
 				if x.c >= kd {
-					return true
+					return v, true
 				}
 
 				if q != t.r {
 					t.underflow(p, x, pi)
 				} else if t.c == 0 {
-					t.Clear()
+					t.clear()
 				}
-				return true
+				return v, true
 			}
 		}
 
@@ -326,9 +1462,294 @@ func (t *Tree) Delete(k interface{} /*K*/) (ok bool) {
 			p = x
 			q = x.x[i].ch
 		case *d:
-			return false
+			return v, false
+		}
+	}
+}
+
+// DeleteFunc removes all KV pairs for which pred returns true and returns
+// their number. The remaining items are packed to the data pages in a single
+// pass along the pages, then the index pages are rebuilt. DeleteFunc is O(n),
+// regardless of the number of the removed items.
+func (t *Tree) DeleteFunc(pred func(k interface{} /*K*/, v interface{} /*V*/) bool) (n int) {
+	if t.r == nil {
+		return 0
+	}
+
+	// Writing the kept items densely never overtakes the reading. The items
+	// of wq from w on are written with their whole keys and compressed once
+	// the page is written.
+	var removed []Item
+	wq, wi, w := t.first, 0, 0
+	for q := t.first; q != nil; q = q.n {
+		pfx := q.pfx
+		for i, it := range q.d[:q.c] {
+			k := it.k
+			if t.compress {
+				k = join(pfx, k)
+			}
+			if pred(k, it.v) {
+				if t.obs != nil {
+					removed = append(removed, Item{k, it.v})
+				}
+				n++
+				continue
+			}
+
+			if n == 0 { // Nothing is removed yet, the item stays.
+				wq, wi, w = q, i+1, i+1
+				continue
+			}
+
+			if wi == 2*kd {
+				wq.c = wi
+				t.encode(wq, w, wi, "")
+				wq, wi, w = wq.n, 0, 0
+			}
+			wq.d[wi] = de{k, it.v}
+			wi++
+		}
+	}
+	switch {
+	case n == 0:
+		return 0
+	case n == t.c:
+		t.clear()
+	default:
+		for i := range wq.d[wi:] {
+			wq.d[wi+i] = zde // GC
+		}
+		wq.c = wi
+		t.encode(wq, w, wi, "")
+		for r := wq.n; r != nil; {
+			n := r.n
+			*r = zd
+			btDPool.Put(r)
+			r = n
+		}
+		wq.n, t.last = nil, wq
+		if p := wq.p; p != nil && wq.c < kd {
+			m := (p.c+wq.c)/2 - wq.c
+			t.mvR(p, wq, m)
+			for i := range p.d[p.c : p.c+m] {
+				p.d[p.c+i] = zde // GC
+			}
 		}
+
+		var f func(q interface{})
+		f = func(q interface{}) {
+			if x, ok := q.(*x); ok {
+				for i := 0; i <= x.c; i++ {
+					f(x.x[i].ch)
+				}
+				*x = zx
+				btXPool.Put(x)
+			}
+		}
+		f(t.r)
+		var leaves []*d
+		for q := t.first; q != nil; q = q.n {
+			leaves = append(leaves, q)
+		}
+		t.c -= n
+		t.nd, t.nx = len(leaves), 0
+		t.ver++
+		t.buildIndex(leaves)
+	}
+	for _, it := range removed {
+		t.obs(OpDelete, it.K, it.V, zv)
 	}
+	return n
+}
+
+// Diff returns the differences between t and other in key order, as reported
+// by DiffFunc.
+func (t *Tree) Diff(other *Tree, valueEq func(a, b interface{} /*V*/) bool) (r []Difference) {
+	t.DiffFunc(other, valueEq, func(d Difference) bool {
+		r = append(r, d)
+		return true
+	})
+	return r
+}
+
+// DiffFunc calls fn for every key which differs between t and other, in key
+// order, until fn returns false. A key found only in other is reported as
+// DiffAdded, a key found only in t as DiffRemoved and a key found in both
+// trees having values not equal according to valueEq as DiffChanged. If
+// valueEq is nil, the values are compared using ==. The keys are collated
+// by the compare function of t.
+//
+// DiffFunc merges the data pages of the trees, it's O(t.Len()+other.Len()).
+func (t *Tree) DiffFunc(other *Tree, valueEq func(a, b interface{} /*V*/) bool, fn func(d Difference) (more bool)) {
+	if valueEq == nil {
+		valueEq = valuesEqual
+	}
+
+	p, i := t.first, 0
+	q, j := other.first, 0
+	for p != nil || q != nil {
+		var c int
+		var pk, qk interface{} /*K*/
+		switch {
+		case p == nil:
+			c = 1
+			qk = other.key(q, j)
+		case q == nil:
+			c = -1
+			pk = t.key(p, i)
+		default:
+			pk, qk = t.key(p, i), other.key(q, j)
+			c = t.cmp(pk, qk)
+		}
+		var df Difference
+		switch {
+		case c < 0:
+			df = Difference{Kind: DiffRemoved, K: pk, Old: p.d[i].v}
+			p, i = fwd(p, i+1)
+		case c > 0:
+			df = Difference{Kind: DiffAdded, K: qk, New: q.d[j].v}
+			q, j = fwd(q, j+1)
+		default:
+			a, b := &p.d[i], &q.d[j]
+			p, i = fwd(p, i+1)
+			q, j = fwd(q, j+1)
+			if valueEq(a.v, b.v) {
+				continue
+			}
+
+			df = Difference{Kind: DiffChanged, K: pk, Old: a.v, New: b.v}
+		}
+		if !fn(df) {
+			return
+		}
+	}
+}
+
+// Equal reports whether t and other have the same keys associated with equal
+// values according to valueEq, see DiffFunc.
+func (t *Tree) Equal(other *Tree, valueEq func(a, b interface{} /*V*/) bool) (eq bool) {
+	if t.c != other.c {
+		return false
+	}
+
+	eq = true
+	t.DiffFunc(other, valueEq, func(Difference) bool {
+		eq = false
+		return false
+	})
+	return eq
+}
+
+// EstimateRange returns an estimate n of the number of items with keys in
+// [lo, hi) and the bound of its error: the exact number is in [n-maxErr,
+// n+maxErr]. EstimateRange is O(log n).
+//
+// If the Monoid of t has a Count, the pages of t keep the number of the items
+// of their subtrees and EstimateRange returns the exact count from Aggregate.
+// Otherwise only the items of the data pages where lo and hi belong are
+// counted exactly. The subtrees between those pages, or the ones outside of
+// them, whichever bounds the result tighter, are estimated using the average
+// fill of the data pages and the average fan-out of the index pages. The
+// error bound follows from the minimal and maximal fill of the pages. maxErr
+// is zero if n is exact, eg. if lo and hi belong to the same or adjacent data
+// pages.
+func (t *Tree) EstimateRange(lo, hi interface{} /*K*/) (n, maxErr int) {
+	if t.r == nil || t.cmp(lo, hi) >= 0 {
+		return 0, 0
+	}
+
+	if m := t.userMonoid(); m != nil && m.Count != nil {
+		return m.Count(t.Aggregate(lo, hi)), 0
+	}
+
+	// Subtrees between lo and hi (mid) and outside of [lo, hi) (out) by
+	// their depth.
+	var mid, out [64]int
+	h := 0
+	p, q := t.r, t.r
+	for {
+		switch a := p.(type) {
+		case *x:
+			b := q.(*x)
+			i, j := t.child(a, lo), t.child(b, hi)
+			switch {
+			case a != b:
+				mid[h] = a.c - i + j
+			case j > i:
+				mid[h] = j - i - 1
+			}
+			out[h] = i + b.c - j
+			h++
+			p, q = a.x[i].ch, b.x[j].ch
+		case *d:
+			b := q.(*d)
+			i, _ := t.find(a, lo)
+			j, _ := t.find(b, hi)
+			in := a.c - i + j
+			if a == b {
+				in = j - i
+			}
+			return t.estimate(in, t.c-i-b.c+j, mid[:h], out[:h])
+		}
+	}
+}
+
+// estimate computes the result of EstimateRange. in is the number of the items
+// of the data pages of lo and hi in [lo, hi), ex is t.c less the number of
+// those outside of it. mid and out are the numbers of the subtrees between lo
+// and hi and outside of [lo, hi) by their depth.
+func (t *Tree) estimate(in, ex int, mid, out []int) (n, maxErr int) {
+	aLo, aHi, aEst := in, in, float64(in)
+	bLo, bHi, bEst := ex, ex, float64(ex)
+	if t.nx != 0 {
+		// Sizes of the subtrees of a height, starting with the data pages.
+		min, max := kd, 2*kd
+		avg := float64(t.c) / float64(t.nd)
+		fan := float64(t.nd+t.nx-1) / float64(t.nx)
+		for l := len(mid) - 1; l >= 0; l-- {
+			aLo += mid[l] * min
+			aHi += mid[l] * max
+			aEst += float64(mid[l]) * avg
+			bLo -= out[l] * max
+			bHi -= out[l] * min
+			bEst -= float64(out[l]) * avg
+			if min *= kx; min > t.c {
+				min = t.c
+			}
+			if max *= 2*kx + 2; max > t.c {
+				max = t.c
+			}
+			avg *= fan
+		}
+	}
+
+	est := aEst
+	if bHi-bLo < aHi-aLo {
+		est = bEst
+	}
+	lo, hi := aLo, aHi
+	if bLo > lo {
+		lo = bLo
+	}
+	if lo < 0 {
+		lo = 0
+	}
+	if bHi < hi {
+		hi = bHi
+	}
+	if hi > t.c {
+		hi = t.c
+	}
+	switch n = int(est + 0.5); {
+	case n < lo:
+		n = lo
+	case n > hi:
+		n = hi
+	}
+	if maxErr = hi - n; n-lo > maxErr {
+		maxErr = n - lo
+	}
+	return n, maxErr
 }
 
 func (t *Tree) extract(q *d, i int) { // (r interface{} /*V*/) {
@@ -343,6 +1764,10 @@ func (t *Tree) extract(q *d, i int) { // (r interface{} /*V*/) {
 }
 
 func (t *Tree) find(q interface{}, k interface{} /*K*/) (i int, ok bool) {
+	if t.fastFind != nil {
+		return t.fastFind(q, k)
+	}
+
 	var mk interface{} /*K*/
 	l := 0
 	switch x := q.(type) {
@@ -382,12 +1807,21 @@ func (t *Tree) find(q interface{}, k interface{} /*K*/) (i int, ok bool) {
 // (zero-value, zero-value) if the tree is empty.
 func (t *Tree) First() (k interface{} /*K*/, v interface{} /*V*/) {
 	if q := t.first; q != nil {
-		q := &q.d[0]
-		k, v = q.k, q.v
+		k, v = t.key(q, 0), q.d[0].v
 	}
 	return
 }
 
+// Floor returns the item with the greatest key <= k. If there's no such item,
+// ok is false.
+func (t *Tree) Floor(k interface{} /*K*/) (fk interface{} /*K*/, v interface{} /*V*/, ok bool) {
+	q, i, ok := t.locate(k)
+	if !ok {
+		i--
+	}
+	return t.item(q, i)
+}
+
 // Get returns the value associated with k and true if it exists. Otherwise Get
 // returns (zero-value, false).
 func (t *Tree) Get(k interface{} /*K*/) (v interface{} /*V*/, ok bool) {
@@ -404,6 +1838,9 @@ func (t *Tree) Get(k interface{} /*K*/) (v interface{} /*V*/, ok bool) {
 				q = x.x[i+1].ch
 				continue
 			case *d:
+				if t.lru != nil {
+					t.lru.touch(k)
+				}
 				return x.d[i].v, true
 			}
 		}
@@ -416,6 +1853,16 @@ func (t *Tree) Get(k interface{} /*K*/) (v interface{} /*V*/, ok bool) {
 	}
 }
 
+// Higher returns the item with the least key > k. If there's no such item, ok
+// is false.
+func (t *Tree) Higher(k interface{} /*K*/) (hk interface{} /*K*/, v interface{} /*V*/, ok bool) {
+	q, i, ok := t.locate(k)
+	if ok {
+		i++
+	}
+	return t.item(q, i)
+}
+
 func (t *Tree) insert(q *d, i int, k interface{} /*K*/, v interface{} /*V*/) *d {
 	t.ver++
 	c := q.c
@@ -425,6 +1872,7 @@ func (t *Tree) insert(q *d, i int, k interface{} /*K*/, v interface{} /*V*/) *d
 	c++
 	q.c = c
 	q.d[i].k, q.d[i].v = k, v
+	t.encode(q, i, i+1, "")
 	t.c++
 	return q
 }
@@ -433,8 +1881,7 @@ func (t *Tree) insert(q *d, i int, k interface{} /*K*/, v interface{} /*V*/) *d
 // (zero-value, zero-value) if the tree is empty.
 func (t *Tree) Last() (k interface{} /*K*/, v interface{} /*V*/) {
 	if q := t.last; q != nil {
-		q := &q.d[q.c-1]
-		k, v = q.k, q.v
+		k, v = t.key(q, q.c-1), q.d[q.c-1].v
 	}
 	return
 }
@@ -444,22 +1891,59 @@ func (t *Tree) Len() int {
 	return t.c
 }
 
+// locate returns the data page where k belongs and the index of the first
+// item in it having key >= k, which may be q.c. ok reports whether the item's
+// key equals k. For an empty tree q is nil.
+func (t *Tree) locate(k interface{} /*K*/) (q *d, i int, ok bool) {
+	p := t.r
+	if p == nil {
+		return
+	}
+
+	for {
+		if i, ok = t.find(p, k); ok {
+			switch x := p.(type) {
+			case *x:
+				p = x.x[i+1].ch
+				continue
+			case *d:
+				return x, i, true
+			}
+		}
+
+		switch x := p.(type) {
+		case *x:
+			p = x.x[i].ch
+		case *d:
+			return x, i, false
+		}
+	}
+}
+
+// Lower returns the item with the greatest key < k. If there's no such item,
+// ok is false.
+func (t *Tree) Lower(k interface{} /*K*/) (lk interface{} /*K*/, v interface{} /*V*/, ok bool) {
+	q, i, _ := t.locate(k)
+	return t.item(q, i-1)
+}
+
 func (t *Tree) overflow(p *x, q *d, pi, i int, k interface{} /*K*/, v interface{} /*V*/) {
 	t.ver++
+	t.rebal = true
 	l, r := p.siblings(pi)
 
 	if l != nil && l.c < 2*kd && i != 0 {
-		l.mvL(q, 1)
+		t.mvL(l, q, 1)
 		t.insert(q, i-1, k, v)
-		p.x[pi-1].k = q.d[0].k
+		p.x[pi-1].k = t.key(q, 0)
 		return
 	}
 
 	if r != nil && r.c < 2*kd {
 		if i < 2*kd {
-			q.mvR(r, 1)
+			t.mvR(q, r, 1)
 			t.insert(q, i, k, v)
-			p.x[pi].k = r.d[0].k
+			p.x[pi].k = t.key(r, 0)
 			return
 		}
 
@@ -468,36 +1952,589 @@ func (t *Tree) overflow(p *x, q *d, pi, i int, k interface{} /*K*/, v interface{
 		return
 	}
 
-	t.split(p, q, pi, i, k, v)
+	t.split(p, q, pi, i, k, v)
+}
+
+// Partitions splits the keys of t into at most n consecutive ranges having
+// roughly equal item counts. The partitions are computed from the index pages
+// only, without visiting the data pages, by descending to the first level of
+// the tree having at least 4*n pages and estimating the item count of every
+// page of that level. Trees too small to have n pages on any level yield fewer
+// partitions. An empty tree yields none.
+//
+// The enumerators of the partitions may be used concurrently, provided the
+// tree is not mutated.
+func (t *Tree) Partitions(n int) []Partition {
+	if n < 1 || t.r == nil {
+		return nil
+	}
+
+	type sub struct {
+		q  interface{}
+		lo interface{} /*K*/
+		w  int
+	}
+
+	level := []sub{{q: t.r, lo: t.key(t.first, 0)}}
+	for len(level) < 4*n {
+		if _, ok := level[0].q.(*x); !ok {
+			break
+		}
+
+		var next []sub
+		for _, s := range level {
+			x := s.q.(*x)
+			for i := 0; i <= x.c; i++ {
+				lo := s.lo
+				if i > 0 {
+					lo = x.x[i-1].k
+				}
+				next = append(next, sub{q: x.x[i].ch, lo: lo})
+			}
+		}
+		level = next
+	}
+
+	// The weight of a page is the number of its items or of its
+	// grandchildren.
+	total := 0
+	for i := range level {
+		s := &level[i]
+		switch p := s.q.(type) {
+		case *x:
+			for j := 0; j <= p.c; j++ {
+				switch ch := p.x[j].ch.(type) {
+				case *x:
+					s.w += ch.c + 1
+				case *d:
+					s.w += ch.c
+				}
+			}
+		case *d:
+			s.w = p.c
+		}
+		total += s.w
+	}
+
+	r := make([]Partition, 0, n)
+	lo, w, cum := level[0].lo, 0, 0
+	for i, s := range level {
+		w += s.w
+		cum += s.w
+		last := i == len(level)-1
+		if !last && (len(r) == n-1 || cum*n < total*(len(r)+1)) {
+			continue
+		}
+
+		p := Partition{Count: int(int64(w) * int64(t.c) / int64(total)), Lo: lo, t: t}
+		if !last {
+			p.Hi, p.HasHi = level[i+1].lo, true
+			lo = p.Hi
+		}
+		r = append(r, p)
+		w = 0
+	}
+	return r
+}
+
+// Enumerator returns an Enumerator of the items of p. Next returns io.EOF
+// after the last item of p.
+func (p *Partition) Enumerator() *Enumerator {
+	e, _ := p.t.Seek(p.Lo)
+	e.lo, e.hasLo = p.Lo, true
+	e.hi, e.hasHi = p.Hi, p.HasHi
+	return e
+}
+
+// PopFirst removes the first item of the tree in the key collating order and
+// returns it. If the tree is empty, ok is false. PopFirst is cheaper than
+// First followed by Delete, it walks only the leftmost path of the tree and it
+// performs no key comparisons.
+func (t *Tree) PopFirst() (k interface{} /*K*/, v interface{} /*V*/, ok bool) {
+	if k, v, ok = t.pop(false); ok && t.obs != nil {
+		t.obs(OpDelete, k, v, zv)
+	}
+	return k, v, ok
+}
+
+// PopFirstN removes up to n first items of the tree in the key collating order
+// and returns them. Items are taken from the first data page directly for as
+// long as the page does not underflow, the tree is walked from its root only
+// to rebalance the page.
+func (t *Tree) PopFirstN(n int) (keys []interface{} /*K*/, values []interface{} /*V*/) {
+	for len(keys) < n {
+		q := t.first
+		if q == nil {
+			break
+		}
+
+		m := n - len(keys)
+		switch {
+		case q == t.r:
+			if m > q.c {
+				m = q.c
+			}
+		case q.c-kd < m:
+			m = q.c - kd
+		}
+		if m <= 0 {
+			k, v, _ := t.pop(false)
+			keys, values = append(keys, k), append(values, v)
+			continue
+		}
+
+		for i, it := range q.d[:m] {
+			keys, values = append(keys, t.key(q, i)), append(values, it.v)
+		}
+		copy(q.d[:], q.d[m:q.c])
+		for i := range q.d[q.c-m : q.c] {
+			q.d[q.c-m+i] = zde // GC
+		}
+		q.c -= m
+		t.c -= m
+		t.ver++
+		switch {
+		case t.c == 0:
+			t.clear()
+		case t.mon != nil:
+			t.augment(keys[len(keys)-1])
+		}
+	}
+	if t.obs != nil {
+		for i, k := range keys {
+			t.obs(OpDelete, k, values[i], zv)
+		}
+	}
+	return keys, values
+}
+
+// RandomItem returns an item of t chosen uniformly at random, or ok == false
+// if the tree is empty. If rng is nil, the random source of t is used, see
+// Options.Seed.
+//
+// RandomItem descends from the root to a data page choosing the children of
+// the index pages with probabilities weighted by their fan-outs. The
+// remaining bias, due to the different fill of the pages, is removed by
+// rejecting some of the descents, which are then repeated. The expected number
+// of the descents depends only on the average fill of the pages, RandomItem
+// is thus O(log n).
+func (t *Tree) RandomItem(rng *rand.Rand) (k interface{} /*K*/, v interface{} /*V*/, ok bool) {
+	if t.r == nil {
+		return k, v, false
+	}
+
+	rng = t.rand(rng)
+	for {
+		if q, i, ok := t.pick(rng, false, zk, zk); ok {
+			return t.key(q, i), q.d[i].v, true
+		}
+	}
+}
+
+// Sample returns n distinct items with keys in [lo, hi) chosen uniformly at
+// random, in the key collating order. If there are less than n items in the
+// range, all of them are returned. If rng is nil, the random source of t is
+// used, see Options.Seed.
+//
+// Sample draws the items like RandomItem, descending only to the subtrees
+// overlapping [lo, hi), if the range is estimated to have more than 2n items.
+// Otherwise, or if too many of the descents miss the range, Sample falls back
+// to reservoir sampling of all the items in the range.
+func (t *Tree) Sample(lo, hi interface{} /*K*/, n int, rng *rand.Rand) (r []Item) {
+	if n <= 0 || t.r == nil || t.cmp(lo, hi) >= 0 {
+		return nil
+	}
+
+	rng = t.rand(rng)
+	if m, maxErr := t.EstimateRange(lo, hi); m-maxErr > 2*n {
+		type pos struct {
+			q *d
+			i int
+		}
+		seen := map[pos]bool{}
+		for tries := 16*n + 64; tries != 0 && len(r) < n; tries-- {
+			q, i, ok := t.pick(rng, true, lo, hi)
+			if !ok || seen[pos{q, i}] {
+				continue
+			}
+
+			seen[pos{q, i}] = true
+			r = append(r, Item{t.key(q, i), q.d[i].v})
+		}
+		if len(r) == n {
+			sort.Sort(itemSorter{r, t.cmp})
+			return r
+		}
+
+		r = r[:0]
+	}
+
+	// Reservoir sampling of the items in [lo, hi), which are already in
+	// order, so the result is sorted at the end only if any item was
+	// replaced.
+	replaced := false
+	q, i, _ := t.locate(lo)
+	for m := 0; q != nil; m++ {
+		if i == q.c {
+			if q, i = q.n, 0; q == nil {
+				break
+			}
+		}
+
+		k := t.key(q, i)
+		if t.cmp(k, hi) >= 0 {
+			break
+		}
+
+		switch {
+		case m < n:
+			r = append(r, Item{k, q.d[i].v})
+		default:
+			if j := rng.Intn(m + 1); j < n {
+				r[j] = Item{k, q.d[i].v}
+				replaced = true
+			}
+		}
+		i++
+	}
+	if replaced {
+		sort.Sort(itemSorter{r, t.cmp})
+	}
+	return r
+}
+
+// pick performs one descent of RandomItem or Sample. If bounded, only the
+// subtrees overlapping [lo, hi) are visited. A successful descent returns
+// every item, with a key in [lo, hi) if bounded, with the same probability.
+func (t *Tree) pick(rng *rand.Rand, bounded bool, lo, hi interface{} /*K*/) (q *d, i int, ok bool) {
+	for p, root := t.r, true; ; root = false {
+		switch y := p.(type) {
+		case *x:
+			a, b := 0, y.c
+			if bounded {
+				a, b = t.child(y, lo), t.child(y, hi)
+			}
+			// The weight of a child is its fan-out.
+			w, max := 0, 2*kx+2
+			for j := a; j <= b; j++ {
+				switch ch := y.x[j].ch.(type) {
+				case *x:
+					w += ch.c + 1
+				case *d:
+					w += ch.c
+					max = 2 * kd
+				}
+			}
+			// The probability of choosing a child is proportional to
+			// its fan-out, the probability of choosing a grandchild
+			// would thus depend on w. Accepting the descent with a
+			// probability proportional to w cancels that, except for
+			// the root, where nothing needs to be canceled.
+			if !root && rng.Int63n(int64((y.c+1)*max)) >= int64(w) {
+				return nil, 0, false
+			}
+
+			j := rng.Intn(w)
+			for p = nil; p == nil; a++ {
+				switch ch := y.x[a].ch.(type) {
+				case *x:
+					if j -= ch.c + 1; j < 0 {
+						p = ch
+					}
+				case *d:
+					if j -= ch.c; j < 0 {
+						p = ch
+					}
+				}
+			}
+		case *d:
+			i = rng.Intn(y.c)
+			if k := t.key(y, i); bounded && (t.cmp(k, lo) < 0 || t.cmp(k, hi) >= 0) {
+				return nil, 0, false
+			}
+
+			return y, i, true
+		}
+	}
+}
+
+// rngMu guards the lazy creation of the random sources of trees.
+var rngMu sync.Mutex
+
+// lockedSource is a rand.Source safe for concurrent use.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() (n int64) {
+	s.mu.Lock()
+	n = s.src.Int63()
+	s.mu.Unlock()
+	return n
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	s.src.Seed(seed)
+	s.mu.Unlock()
+}
+
+// rand returns rng or, if it's nil, the random source of t. The random source
+// of t is safe for concurrent use, so RandomItem and Sample only read the tree.
+func (t *Tree) rand(rng *rand.Rand) *rand.Rand {
+	if rng != nil {
+		return rng
+	}
+
+	rngMu.Lock()
+	defer rngMu.Unlock()
+
+	if t.rng == nil {
+		seed := t.seed
+		if seed == 0 {
+			seed = rand.Int63()
+		}
+		t.rng = rand.New(&lockedSource{src: rand.NewSource(seed)})
+	}
+	return t.rng
+}
+
+// RangeHash returns the hash of the items having keys in [lo, hi), computed
+// in O(log n). Trees with equal items in the range have equal range hashes,
+// regardless of their shape or the order of their mutations. Two replicas
+// can thus find the ranges where they differ by comparing range hashes and
+// bisecting the ranges having different hashes. RangeHash panics if the tree
+// has no Hasher, see Options.Hasher.
+func (t *Tree) RangeHash(lo, hi interface{} /*K*/) uint64 {
+	if t.hasher == nil {
+		panic("b: tree has no Hasher")
+	}
+
+	if t.cmp(lo, hi) >= 0 || t.r == nil {
+		return 0
+	}
+
+	return t.aggregate(t.r, lo, hi, true, true).(hashAggregate).h
+}
+
+// RootHash returns the hash of all items in the tree, see also RangeHash.
+// RootHash panics if the tree has no Hasher, see Options.Hasher.
+func (t *Tree) RootHash() uint64 {
+	if t.hasher == nil {
+		panic("b: tree has no Hasher")
+	}
+
+	if t.r == nil {
+		return 0
+	}
+
+	return aggregate(t.r).(hashAggregate).h
+}
+
+// PopLast removes the last item of the tree in the key collating order and
+// returns it. If the tree is empty, ok is false. See also PopFirst.
+func (t *Tree) PopLast() (k interface{} /*K*/, v interface{} /*V*/, ok bool) {
+	if k, v, ok = t.pop(true); ok && t.obs != nil {
+		t.obs(OpDelete, k, v, zv)
+	}
+	return k, v, ok
+}
+
+// pop removes the first or the last item of the tree. It rebalances the tree
+// on the way down like Delete does.
+func (t *Tree) pop(last bool) (k interface{} /*K*/, v interface{} /*V*/, ok bool) {
+	pi := -1
+	var p *x
+	q := t.r
+	if q == nil {
+		return
+	}
+
+	for {
+		switch x := q.(type) {
+		case *x:
+			i := 0
+			if last {
+				i = x.c
+			}
+			if x.c < kx && q != t.r {
+				x, i = t.underflowX(p, x, pi, i)
+			}
+			pi = i
+			p = x
+			q = x.x[i].ch
+		case *d:
+			i := 0
+			if last {
+				i = x.c - 1
+			}
+			k, v = t.key(x, i), x.d[i].v
+			t.extract(x, i)
+			if x.c < kd {
+				if q != t.r {
+					t.underflow(p, x, pi)
+				} else if t.c == 0 {
+					t.clear()
+				}
+			}
+			if t.mon != nil {
+				t.augment(k)
+			}
+			return k, v, true
+		}
+	}
+}
+
+// SetObserver sets the Observer of t, which is called after every mutation of
+// t. Passing nil removes the Observer. Trees without an Observer incur no
+// costs for the feature.
+func (t *Tree) SetObserver(o Observer) {
+	t.uobs = o
+	t.hook()
+}
+
+// hook sets t.obs to the cheapest function handling the mutations of t.
+func (t *Tree) hook() {
+	switch {
+	case t.max > 0 || t.maxBytes > 0 || t.sizer != nil:
+		t.obs = t.observe
+	default:
+		t.obs = t.uobs
+	}
+}
+
+// observe maintains the state of t depending on its mutations. It passes the
+// mutation to the user's Observer and evicts items if t is full.
+func (t *Tree) observe(op Op, k interface{} /*K*/, oldV, newV interface{} /*V*/) {
+	t.register(op, k, oldV, newV)
+	if op == OpInsert || op == OpUpdate && t.maxBytes > 0 {
+		t.evictFull()
+	}
+}
+
+// observeAll passes the mutations performed by a single call of a batch
+// method, like ApplySorted, to the Observer of t. Items are evicted only after
+// all the mutations are registered, so the Observer never sees an insert of an
+// already evicted key.
+func (t *Tree) observeAll(changes []Change) {
+	if t.max <= 0 && t.maxBytes <= 0 && t.sizer == nil {
+		for _, c := range changes {
+			t.obs(c.Op, c.K, c.Old, c.New)
+		}
+		return
+	}
+
+	for _, c := range changes {
+		t.register(c.Op, c.K, c.Old, c.New)
+	}
+	t.evictFull()
+}
+
+// register updates the state of t kept for the Options and passes the
+// mutation to the user's Observer.
+func (t *Tree) register(op Op, k interface{} /*K*/, oldV, newV interface{} /*V*/) {
+	if t.lru != nil {
+		t.lru.update(op, k)
+	}
+	if t.sizer != nil {
+		switch op {
+		case OpInsert:
+			t.bytes += t.sizer(k, newV)
+		case OpUpdate:
+			t.bytes += t.sizer(k, newV) - t.sizer(k, oldV)
+		case OpDelete:
+			t.bytes -= t.sizer(k, oldV)
+		case OpClear:
+			t.bytes = 0
+		}
+	}
+	if t.uobs != nil {
+		t.uobs(op, k, oldV, newV)
+	}
+}
+
+// evictFull evicts items while t is full.
+func (t *Tree) evictFull() {
+	for t.c != 0 && (t.max > 0 && t.c > t.max || t.maxBytes > 0 && t.Bytes() > t.maxBytes) {
+		var k interface{} /*K*/
+		var v interface{} /*V*/
+		switch t.evict {
+		case EvictLargest:
+			k, v, _ = t.pop(true)
+		case EvictLRU:
+			var ok bool
+			if k, ok = t.lru.back(); !ok {
+				return
+			}
+
+			v, _ = t.delete(k, nil, nil, zv)
+		default:
+			k, v, _ = t.pop(false)
+		}
+		t.register(OpDelete, k, v, zv)
+		if t.onEvict != nil {
+			t.onEvict(k, v)
+		}
+	}
+}
+
+// Seek returns an Enumerator positioned on an item such that k >= item's key.
+// ok reports if k == item.key The Enumerator's position is possibly after the
+// last item in the tree.
+func (t *Tree) Seek(k interface{} /*K*/) (e *Enumerator, ok bool) {
+	q, i, ok := t.locate(k)
+	return btEPool.get(nil, ok, i, k, q, t, t.ver), ok
+}
+
+// SeekPrefix returns an Enumerator positioned on the first item having a key
+// with prefix p. The enumeration, in either direction, ends with io.EOF once
+// the keys no longer have that prefix. If no key has prefix p, err == io.EOF
+// is returned and e will be nil.
+//
+// SeekPrefix works only for trees created by TreeNewBytes, TreeNewString or
+// by TreeNewOptions with a PrefixSuccessor.
+func (t *Tree) SeekPrefix(p interface{} /*K*/) (e *Enumerator, err error) {
+	if t.succ == nil {
+		return nil, errors.New("SeekPrefix: tree does not support prefixes")
+	}
+
+	e, _ = t.Seek(p)
+	e.lo, e.hasLo = p, true
+	e.hi, e.hasHi = t.succ(p)
+	q, i := e.q, e.i
+	if q != nil && i >= q.c {
+		q, i = q.n, 0
+	}
+	if q == nil || e.hasHi && t.cmp(t.key(q, i), e.hi) >= 0 {
+		e.Close()
+		return nil, io.EOF
+	}
+
+	return e, nil
 }
 
-// Seek returns an Enumerator positioned on an item such that k >= item's key.
-// ok reports if k == item.key The Enumerator's position is possibly after the
-// last item in the tree.
-func (t *Tree) Seek(k interface{} /*K*/) (e *Enumerator, ok bool) {
-	q := t.r
-	if q == nil {
-		e = btEPool.get(nil, false, 0, k, nil, t, t.ver)
-		return
+// ScanPrefix calls fn for every item having a key with prefix p, in the key
+// collating order, until fn returns false. Any error returned by SeekPrefix
+// except io.EOF is passed through.
+func (t *Tree) ScanPrefix(p interface{} /*K*/, fn func(k interface{} /*K*/, v interface{} /*V*/) (more bool)) error {
+	e, err := t.SeekPrefix(p)
+	if err != nil {
+		if err == io.EOF {
+			err = nil
+		}
+		return err
 	}
 
+	defer e.Close()
 	for {
-		var i int
-		if i, ok = t.find(q, k); ok {
-			switch x := q.(type) {
-			case *x:
-				q = x.x[i+1].ch
-				continue
-			case *d:
-				return btEPool.get(nil, ok, i, k, x, t, t.ver), true
-			}
+		k, v, err := e.Next()
+		if err != nil {
+			return nil
 		}
 
-		switch x := q.(type) {
-		case *x:
-			q = x.x[i].ch
-		case *d:
-			return btEPool.get(nil, ok, i, k, x, t, t.ver), false
+		if !fn(k, v) {
+			return nil
 		}
 	}
 }
@@ -510,7 +2547,7 @@ func (t *Tree) SeekFirst() (e *Enumerator, err error) {
 		return nil, io.EOF
 	}
 
-	return btEPool.get(nil, true, 0, q.d[0].k, q, t, t.ver), nil
+	return btEPool.get(nil, true, 0, t.key(q, 0), q, t, t.ver), nil
 }
 
 // SeekLast returns an enumerator positioned on the last KV pair in the tree,
@@ -521,7 +2558,7 @@ func (t *Tree) SeekLast() (e *Enumerator, err error) {
 		return nil, io.EOF
 	}
 
-	return btEPool.get(nil, true, q.c-1, q.d[q.c-1].k, q, t, t.ver), nil
+	return btEPool.get(nil, true, q.c-1, t.key(q, q.c-1), q, t, t.ver), nil
 }
 
 // Set sets the value associated with k.
@@ -531,11 +2568,21 @@ func (t *Tree) Set(k interface{} /*K*/, v interface{} /*V*/) {
 	//	dbg("--- POST\n%s\n====\n", t.dump())
 	//}()
 
+	if t.obs != nil {
+		t.Put(k, func(interface{} /*V*/, bool) (interface{} /*V*/, bool) { return v, true })
+		return
+	}
+
+	if t.mon != nil {
+		defer t.augment(k)
+	}
+
 	pi := -1
 	var p *x
 	q := t.r
 	if q == nil {
 		z := t.insert(btDPool.Get().(*d), 0, k, v)
+		t.nd++
 		t.r, t.first, t.last = z, z, z
 		return
 	}
@@ -555,6 +2602,7 @@ func (t *Tree) Set(k interface{} /*K*/, v interface{} /*V*/) {
 				continue
 			case *d:
 				x.d[i].v = v
+				t.mod++
 			}
 			return
 		}
@@ -592,75 +2640,181 @@ func (t *Tree) Set(k interface{} /*K*/, v interface{} /*V*/) {
 //
 // modulo the differing return values.
 func (t *Tree) Put(k interface{} /*K*/, upd func(oldV interface{} /*V*/, exists bool) (newV interface{} /*V*/, write bool)) (oldV interface{} /*V*/, written bool) {
-	pi := -1
-	var p *x
-	q := t.r
+	if t.obs == nil {
+		return t.put(k, upd)
+	}
+
+	var exists bool
 	var newV interface{} /*V*/
-	if q == nil {
-		// new KV pair in empty tree
-		newV, written = upd(newV, false)
-		if !written {
-			return
+	if oldV, written = t.put(k, func(oldV interface{} /*V*/, ok bool) (interface{} /*V*/, bool) {
+		exists = ok
+		newV, written = upd(oldV, ok)
+		return newV, written
+	}); written {
+		op := OpInsert
+		if exists {
+			op = OpUpdate
 		}
+		t.obs(op, k, oldV, newV)
+	}
+	return oldV, written
+}
 
-		z := t.insert(btDPool.Get().(*d), 0, k, newV)
-		t.r, t.first, t.last = z, z, z
+func (t *Tree) put(k interface{} /*K*/, upd func(oldV interface{} /*V*/, exists bool) (newV interface{} /*V*/, write bool)) (oldV interface{} /*V*/, written bool) {
+	if t.mon != nil {
+		defer t.augment(k)
+	}
+
+	f, i, ok := t.walk(k)
+	var newV interface{} /*V*/
+	if ok {
+		oldV = f.q.d[i].v
+		if newV, written = upd(oldV, true); written {
+			f.q.d[i].v = newV
+			t.mod++
+		}
 		return
 	}
 
-	for {
-		i, ok := t.find(q, k)
-		if ok {
-			switch x := q.(type) {
-			case *x:
-				i++
-				if x.c > 2*kx {
-					x, i = t.splitX(p, x, pi, i)
-				}
-				pi = i
-				p = x
-				q = x.x[i].ch
-				continue
-			case *d:
-				oldV = x.d[i].v
-				newV, written = upd(oldV, true)
-				if !written {
-					return
-				}
+	if newV, written = upd(newV, false); written {
+		t.insertAt(f, i, k, newV)
+	}
+	return
+}
 
-				x.d[i].v = newV
-			}
-			return
-		}
+// walk returns the position of k in the data page where k belongs, splitting
+// the full index pages on the way down like Set does. If t is empty, f.q is
+// nil.
+func (t *Tree) walk(k interface{} /*K*/) (f finger, i int, ok bool) {
+	f.pi = -1
+	r := t.r
+	if r == nil {
+		return
+	}
 
-		switch x := q.(type) {
+	for {
+		i, ok = t.find(r, k)
+		switch x := r.(type) {
 		case *x:
+			if ok {
+				i++
+			}
 			if x.c > 2*kx {
-				x, i = t.splitX(p, x, pi, i)
+				// The separator moved to f.p bounds the left half.
+				sep, left := x.x[kx].k, i <= kx
+				x, i = t.splitX(f.p, x, f.pi, i)
+				if left {
+					f.hi, f.hasHi = sep, true
+				}
 			}
-			pi = i
-			p = x
-			q = x.x[i].ch
-		case *d: // new KV pair
-			newV, written = upd(newV, false)
-			if !written {
-				return
+			if i < x.c {
+				f.hi, f.hasHi = x.x[i].k, true
 			}
+			f.pi = i
+			f.p = x
+			r = x.x[i].ch
+		case *d:
+			f.q = x
+			return f, i, ok
+		}
+	}
+}
 
-			switch {
-			case x.c < 2*kd:
-				t.insert(x, i, k, newV)
-			default:
-				t.overflow(p, x, pi, i, k, newV)
-			}
-			return
+// insertAt inserts a new KV pair at the position returned by walk.
+func (t *Tree) insertAt(f finger, i int, k interface{} /*K*/, v interface{} /*V*/) {
+	switch q := f.q; {
+	case q == nil: // new KV pair in empty tree
+		z := t.insert(btDPool.Get().(*d), 0, k, v)
+		t.nd++
+		t.r, t.first, t.last = z, z, z
+	case q.c < 2*kd:
+		t.insert(q, i, k, v)
+	default:
+		t.overflow(f.p, q, f.pi, i, k, v)
+	}
+}
+
+// SetIfAbsent sets the value associated with k to v, if k does not exist.
+// SetIfAbsent returns the existing value and true if k exists or v and false
+// otherwise.
+func (t *Tree) SetIfAbsent(k interface{} /*K*/, v interface{} /*V*/) (actual interface{} /*V*/, loaded bool) {
+	f, i, ok := t.walk(k)
+	if ok {
+		actual = f.q.d[i].v
+	} else {
+		t.insertAt(f, i, k, v)
+	}
+	if t.mon != nil {
+		t.augment(k)
+	}
+	switch {
+	case ok:
+		if t.lru != nil {
+			t.lru.touch(k)
+		}
+		return actual, true
+	case t.obs != nil:
+		t.obs(OpInsert, k, zv, v)
+	}
+	return v, false
+}
+
+// CompareAndSwap sets the value associated with k to newV, if k exists and its
+// value equals oldV according to eq. If eq is nil, the values are compared
+// using ==. CompareAndSwap reports whether the value was set.
+func (t *Tree) CompareAndSwap(k interface{} /*K*/, oldV, newV interface{} /*V*/, eq func(a, b interface{} /*V*/) bool) (swapped bool) {
+	if eq == nil {
+		eq = valuesEqual
+	}
+	f, i, ok := t.walk(k)
+	var v interface{} /*V*/
+	if ok {
+		v = f.q.d[i].v
+		if swapped = eq(v, oldV); swapped {
+			f.q.d[i].v = newV
+			t.mod++
 		}
 	}
+	if t.mon != nil {
+		t.augment(k)
+	}
+	if swapped && t.obs != nil {
+		t.obs(OpUpdate, k, v, newV)
+	}
+	return swapped
+}
+
+// CompareAndDelete removes the k's KV pair, if it exists and its value equals
+// oldV according to eq. If eq is nil, the values are compared using ==.
+// CompareAndDelete reports whether the KV pair was removed.
+func (t *Tree) CompareAndDelete(k interface{} /*K*/, oldV interface{} /*V*/, eq func(a, b interface{} /*V*/) bool) (deleted bool) {
+	if eq == nil {
+		eq = valuesEqual
+	}
+	var v interface{} /*V*/
+	if v, deleted = t.delete(k, nil, eq, oldV); deleted && t.obs != nil {
+		t.obs(OpDelete, k, v, zv)
+	}
+	return deleted
+}
+
+// DeleteIf removes the k's KV pair, if it exists and pred returns true for its
+// value. DeleteIf reports whether the KV pair was removed.
+func (t *Tree) DeleteIf(k interface{} /*K*/, pred func(v interface{} /*V*/) bool) (deleted bool) {
+	var v interface{} /*V*/
+	if v, deleted = t.delete(k, pred, nil, zv); deleted && t.obs != nil {
+		t.obs(OpDelete, k, v, zv)
+	}
+	return deleted
 }
 
+func valuesEqual(a, b interface{} /*V*/) bool { return a == b }
+
 func (t *Tree) split(p *x, q *d, pi, i int, k interface{} /*K*/, v interface{} /*V*/) {
 	t.ver++
+	t.rebal = true
 	r := btDPool.Get().(*d)
+	t.nd++
 	if q.n != nil {
 		r.n = q.n
 		r.n.p = r
@@ -675,16 +2829,19 @@ func (t *Tree) split(p *x, q *d, pi, i int, k interface{} /*K*/, v interface{} /
 		q.d[kd+i] = zde
 	}
 	q.c = kd
-	r.c = kd
+	r.c, r.pfx = kd, q.pfx
+	t.pack(q)
+	t.pack(r)
 	var done bool
 	if i > kd {
 		done = true
 		t.insert(r, i-kd, k, v)
 	}
 	if pi >= 0 {
-		p.insert(pi, r.d[0].k, r)
+		p.insert(pi, t.key(r, 0), r)
 	} else {
-		t.r = newX(q).insert(0, r.d[0].k, r)
+		t.r = newX(q).insert(0, t.key(r, 0), r)
+		t.nx++
 	}
 	if done {
 		return
@@ -695,7 +2852,9 @@ func (t *Tree) split(p *x, q *d, pi, i int, k interface{} /*K*/, v interface{} /
 
 func (t *Tree) splitX(p *x, q *x, pi int, i int) (*x, int) {
 	t.ver++
+	t.rebal = true
 	r := btXPool.Get().(*x)
+	t.nx++
 	copy(r.x[:], q.x[kx+1:])
 	q.c = kx
 	r.c = kx
@@ -703,6 +2862,7 @@ func (t *Tree) splitX(p *x, q *x, pi int, i int) (*x, int) {
 		p.insert(pi, q.x[kx].k, r)
 	} else {
 		t.r = newX(q).insert(0, q.x[kx].k, r)
+		t.nx++
 	}
 
 	q.x[kx].k = zk
@@ -719,17 +2879,18 @@ func (t *Tree) splitX(p *x, q *x, pi int, i int) (*x, int) {
 
 func (t *Tree) underflow(p *x, q *d, pi int) {
 	t.ver++
+	t.rebal = true
 	l, r := p.siblings(pi)
 
 	if l != nil && l.c+q.c >= 2*kd {
-		l.mvR(q, 1)
-		p.x[pi-1].k = q.d[0].k
+		t.mvR(l, q, 1)
+		p.x[pi-1].k = t.key(q, 0)
 		return
 	}
 
 	if r != nil && q.c+r.c >= 2*kd {
-		q.mvL(r, 1)
-		p.x[pi].k = r.d[0].k
+		t.mvL(q, r, 1)
+		p.x[pi].k = t.key(r, 0)
 		r.d[r.c] = zde // GC
 		return
 	}
@@ -744,6 +2905,7 @@ func (t *Tree) underflow(p *x, q *d, pi int) {
 
 func (t *Tree) underflowX(p *x, q *x, pi int, i int) (*x, int) {
 	t.ver++
+	t.rebal = true
 	var l, r *x
 
 	if pi >= 0 {
@@ -792,15 +2954,237 @@ func (t *Tree) underflowX(p *x, q *x, pi int, i int) (*x, int) {
 	return q, i
 }
 
+// --------------------------------------------------------------------- Cursor
+
+// Cursor returns a new Cursor of t. The cursor is not positioned on any item
+// until First, Last, Seek or SeekForPrev is called.
+func (t *Tree) Cursor() *Cursor {
+	return &Cursor{t: t, ver: t.ver}
+}
+
+// Close releases the snapshot of c, if any. c must not be used afterwards.
+func (c *Cursor) Close() {
+	if c.src != nil {
+		c.t.Close()
+	}
+	*c = Cursor{}
+}
+
+// Err returns the error which made c invalid, if any. The only such error is
+// ErrConcurrentModification of a Strict cursor. Positioning the cursor by
+// First, Last, Seek or SeekForPrev clears the error.
+func (c *Cursor) Err() error {
+	c.sync()
+	return c.err
+}
+
+// First positions c on the first item of the tree and reports whether c is
+// valid.
+func (c *Cursor) First() bool {
+	c.err, c.mod, c.ver = nil, c.t.mod, c.t.ver
+	return c.at(c.t.first, 0)
+}
+
+// Key returns the key of the current item, or the zero value if c is not
+// valid.
+func (c *Cursor) Key() (k interface{} /*K*/) {
+	if c.Valid() {
+		k = c.k
+	}
+	return k
+}
+
+// Last positions c on the last item of the tree and reports whether c is
+// valid.
+func (c *Cursor) Last() bool {
+	c.err, c.mod, c.ver = nil, c.t.mod, c.t.ver
+	q := c.t.last
+	if q == nil {
+		return c.at(nil, 0)
+	}
+
+	return c.at(q, q.c-1)
+}
+
+// Next moves c to the next item in the key collating order and reports
+// whether c is valid. If the current item was removed from the tree, Next
+// moves to the first item following its key.
+func (c *Cursor) Next() bool {
+	if !c.sync() {
+		return false
+	}
+
+	i := c.i
+	if c.ok {
+		i++
+	}
+	return c.at(fwd(c.q, i))
+}
+
+// Prev moves c to the previous item in the key collating order and reports
+// whether c is valid. If the current item was removed from the tree, Prev
+// moves to the last item preceding its key.
+func (c *Cursor) Prev() bool {
+	if !c.sync() {
+		return false
+	}
+
+	return c.at(back(c.q, c.i-1))
+}
+
+// Seek positions c on the first item with key >= k and reports whether c is
+// valid.
+func (c *Cursor) Seek(k interface{} /*K*/) bool {
+	c.err, c.mod, c.ver = nil, c.t.mod, c.t.ver
+	q, i, _ := c.t.locate(k)
+	return c.at(fwd(q, i))
+}
+
+// SeekForPrev positions c on the last item with key <= k and reports whether c
+// is valid.
+func (c *Cursor) SeekForPrev(k interface{} /*K*/) bool {
+	c.err, c.mod, c.ver = nil, c.t.mod, c.t.ver
+	q, i, ok := c.t.locate(k)
+	if !ok {
+		i--
+	}
+	return c.at(back(q, i))
+}
+
+// SetMode sets the mode of c, see the Enumerator modes. A Snapshot cursor
+// iterates, and seeks, the items as they were when the mode was set.
+func (c *Cursor) SetMode(m EnumeratorMode) {
+	if c.mode == m {
+		return
+	}
+
+	resync := c.ver != c.t.ver
+	if c.src != nil {
+		c.t.Close()
+		c.t, c.src = c.src, nil
+		resync = true
+	}
+	c.mode = m
+	if m == Snapshot {
+		c.src, c.t = c.t, c.t.clone(nil)
+		resync = true
+	}
+	if resync {
+		c.ver = -1
+	}
+	c.mod = c.t.mod
+}
+
+// Valid reports whether c is positioned on an item.
+func (c *Cursor) Valid() bool {
+	return c.sync() && c.ok
+}
+
+// Value returns the value of the current item, or the zero value if c is not
+// valid.
+func (c *Cursor) Value() (v interface{} /*V*/) {
+	if c.Valid() {
+		v = c.q.d[c.i].v
+	}
+	return v
+}
+
+// at positions c on the item i of q. A nil q makes c invalid.
+func (c *Cursor) at(q *d, i int) bool {
+	if q == nil {
+		c.q, c.ok, c.set = nil, false, false
+		return false
+	}
+
+	c.q, c.i, c.k, c.ok, c.set = q, i, c.t.key(q, i), true, true
+	return true
+}
+
+// sync repositions c after the tree was mutated. It reports whether c can
+// move.
+func (c *Cursor) sync() bool {
+	if c.err != nil || !c.set {
+		return false
+	}
+
+	if c.ver == c.t.ver && (c.mode != Strict || c.mod == c.t.mod) {
+		return true
+	}
+
+	if c.mode == Strict && c.ver >= 0 {
+		c.err = ErrConcurrentModification
+		c.q, c.ok, c.set = nil, false, false
+		return false
+	}
+
+	c.q, c.i, c.ok = c.t.locate(c.k)
+	c.ver = c.t.ver
+	return true
+}
+
 // ----------------------------------------------------------------- Enumerator
 
 // Close recycles e to a pool for possible later reuse. No references to e
 // should exist or such references must not be used afterwards.
 func (e *Enumerator) Close() {
+	if e.src != nil {
+		e.t.Close()
+	}
 	*e = ze
 	btEPool.Put(e)
 }
 
+// Delete removes the item most recently returned by Next or Prev from the
+// tree. It reports whether the item was removed, ie. whether it existed. The
+// enumeration continues with the item following the removed one in the
+// direction of the enumeration.
+//
+// Unless the removal has to rebalance the tree, Delete removes the item
+// directly from its data page and the enumeration continues without seeking
+// the tree from its root.
+func (e *Enumerator) Delete() (ok bool) {
+	if !e.ret {
+		return false
+	}
+
+	if e.src != nil {
+		return e.src.Delete(e.k)
+	}
+
+	t := e.t
+	q := e.cq
+	if e.ver != t.ver || q == nil || q.c <= kd && q != t.r {
+		e.cq = nil
+		ver := t.ver
+		if ok = t.Delete(e.k); ok && e.ver == ver {
+			e.resync()
+		}
+		return ok
+	}
+
+	v := q.d[e.ci].v
+	path := e.pver == t.ver
+	t.extract(q, e.ci)
+	if path { // The pages are kept, so is the path.
+		e.pver = t.ver
+	}
+	if e.q == q && e.i > e.ci {
+		e.i--
+	}
+	e.cq, e.ver = nil, t.ver
+	switch {
+	case t.c == 0:
+		t.clear()
+		e.ver = t.ver
+	case t.mon != nil:
+		t.augment(e.k)
+	}
+	if t.obs != nil {
+		t.obs(OpDelete, e.k, v, zv)
+	}
+	return true
+}
+
 // Next returns the currently enumerated item, if it exists and moves to the
 // next item in the key collation order. If there is no item to return, err ==
 // io.EOF is returned.
@@ -809,10 +3193,17 @@ func (e *Enumerator) Next() (k interface{} /*K*/, v interface{} /*V*/, err error
 		return
 	}
 
-	if e.ver != e.t.ver {
-		f, _ := e.t.Seek(e.k)
-		*e = *f
-		f.Close()
+	if e.ver != e.t.ver || e.mode == Strict && e.mod != e.t.mod {
+		if e.mode == Strict && e.ver >= 0 {
+			e.err, err = ErrConcurrentModification, ErrConcurrentModification
+			return
+		}
+
+		if e.resync() {
+			if err = e.next(); err != nil {
+				return
+			}
+		}
 	}
 	if e.q == nil {
 		e.err, err = io.EOF, io.EOF
@@ -825,9 +3216,15 @@ func (e *Enumerator) Next() (k interface{} /*K*/, v interface{} /*V*/, err error
 		}
 	}
 
-	i := e.q.d[e.i]
-	k, v = i.k, i.v
-	e.k, e.hit = k, true
+	k = e.t.key(e.q, e.i)
+	if e.hasHi && e.t.cmp(k, e.hi) >= 0 {
+		e.err, err = io.EOF, io.EOF
+		return
+	}
+
+	v = e.q.d[e.i].v
+	e.k, e.hit, e.ret = k, true, true
+	e.cq, e.ci = e.q, e.i
 	e.next()
 	return
 }
@@ -842,6 +3239,9 @@ func (e *Enumerator) next() error {
 	case e.i < e.q.c-1:
 		e.i++
 	default:
+		if e.pver == e.t.ver {
+			e.step(1)
+		}
 		if e.q, e.i = e.q.n, 0; e.q == nil {
 			e.err = io.EOF
 		}
@@ -849,6 +3249,173 @@ func (e *Enumerator) next() error {
 	return e.err
 }
 
+// SeekFrom positions e on an item such that k >= item's key, like Tree.Seek,
+// and reports whether k == item's key. The enumeration bounds, if any, are
+// kept.
+//
+// e keeps the path of index pages from the root to its data page. SeekFrom
+// climbs the path only up to the first index page whose child on the path
+// bounds k and descends to k from there. Seeking a key near the current
+// position thus compares k with the keys of a few low pages instead of the
+// O(log n) pages of Tree.Seek. The first SeekFrom after e was returned by a
+// Seek* method, or after the tree was mutated, seeks k from the root.
+func (e *Enumerator) SeekFrom(k interface{} /*K*/) (ok bool) {
+	t := e.t
+	if e.pver != t.ver {
+		e.path, e.pver = e.path[:0], t.ver
+	}
+	j := len(e.path) - 1
+	for j >= 0 && !e.path[j].has(t, k) {
+		j--
+	}
+	q, i, ok := e.descend(j, k)
+	e.cq, e.err, e.hit, e.i, e.k, e.mod, e.q, e.ret, e.ver = nil, nil, ok, i, k, t.mod, q, false, t.ver
+	return ok
+}
+
+// descend seeks k from the child of the index page j of the path of e, or
+// from the root if j < 0, and updates the path below j accordingly.
+func (e *Enumerator) descend(j int, k interface{} /*K*/) (q *d, i int, ok bool) {
+	t := e.t
+	p := t.r
+	if j >= 0 {
+		p = e.path[j].x.x[e.path[j].i].ch
+	}
+	e.path = e.path[:j+1]
+	for p != nil {
+		i, ok = t.find(p, k)
+		switch x := p.(type) {
+		case *x:
+			if ok {
+				i++
+			}
+			e.path = append(e.path, pe{i: i, x: x})
+			e.bound(len(e.path) - 1)
+			p = x.x[i].ch
+		case *d:
+			return x, i, ok
+		}
+	}
+	return nil, 0, false
+}
+
+// step moves the path of e to the data page following, if dir > 0, or
+// preceding, if dir < 0, the current one.
+func (e *Enumerator) step(dir int) {
+	j := len(e.path) - 1
+	for j >= 0 && (e.path[j].i+dir < 0 || e.path[j].i+dir > e.path[j].x.c) {
+		j--
+	}
+	if j < 0 {
+		e.path = e.path[:0]
+		return
+	}
+
+	e.path[j].i += dir
+	e.bound(j)
+	for j++; j < len(e.path); j++ {
+		p := &e.path[j]
+		p.x = e.path[j-1].x.x[e.path[j-1].i].ch.(*x)
+		if p.i = 0; dir < 0 {
+			p.i = p.x.c
+		}
+		e.bound(j)
+	}
+}
+
+// bound sets the bounds of the element j of the path of e.
+func (e *Enumerator) bound(j int) {
+	p := &e.path[j]
+	p.hasHi, p.hasLo, p.hi, p.lo = false, false, zk, zk
+	if j > 0 {
+		u := &e.path[j-1]
+		p.hasHi, p.hasLo, p.hi, p.lo = u.hasHi, u.hasLo, u.hi, u.lo
+	}
+	if p.i > 0 {
+		p.hasLo, p.lo = true, p.x.x[p.i-1].k
+	}
+	if p.i < p.x.c {
+		p.hasHi, p.hi = true, p.x.x[p.i].k
+	}
+}
+
+// has reports whether k is in the bounds of p.
+func (p *pe) has(t *Tree, k interface{} /*K*/) bool {
+	return (!p.hasLo || t.cmp(k, p.lo) >= 0) && (!p.hasHi || t.cmp(k, p.hi) < 0)
+}
+
+// SetMode sets the mode of e, see the Enumerator modes. The mode applies to
+// the tree as it is at the time of the call. The mode of an enumerator
+// returned by the Seek* methods is Resync.
+//
+// Delete and SetValue of a Snapshot Enumerator mutate the enumerated tree,
+// not the snapshot.
+func (e *Enumerator) SetMode(m EnumeratorMode) {
+	if e.mode == m {
+		return
+	}
+
+	resync := e.ver != e.t.ver
+	if e.src != nil {
+		e.t.Close()
+		e.t, e.src = e.src, nil
+		resync = true
+	}
+	e.mode = m
+	if m == Snapshot {
+		e.src, e.t = e.t, e.t.clone(nil)
+		resync = true
+	}
+	if resync {
+		// Let the next Next or Prev reposition e.
+		e.cq, e.path, e.ver = nil, e.path[:0], -1
+	}
+	e.mod = e.t.mod
+}
+
+// SetValue sets the value of the item most recently returned by Next or Prev.
+// It reports whether the item exists. SetValue does not seek the tree from its
+// root unless the tree was mutated since the item was returned.
+func (e *Enumerator) SetValue(v interface{} /*V*/) (ok bool) {
+	if !e.ret {
+		return false
+	}
+
+	t := e.t
+	if e.src != nil {
+		t = e.src
+	} else if q := e.cq; e.ver == t.ver && q != nil {
+		old := q.d[e.ci].v
+		q.d[e.ci].v = v
+		if t.mod++; e.mod == t.mod-1 {
+			e.mod = t.mod
+		}
+		if t.mon != nil {
+			t.augment(e.k)
+		}
+		if t.obs != nil {
+			t.obs(OpUpdate, e.k, old, v)
+		}
+		return true
+	}
+
+	mod := t.mod
+	_, ok = t.Put(e.k, func(_ interface{} /*V*/, exists bool) (interface{} /*V*/, bool) { return v, exists })
+	if e.src == nil && e.mod == mod {
+		e.mod = t.mod
+	}
+	return ok
+}
+
+// resync repositions e after the tree was mutated. The enumeration bounds, if
+// any, are kept. resync reports whether e is positioned on the item it has
+// already returned.
+func (e *Enumerator) resync() bool {
+	q, i, hit := e.t.locate(e.k)
+	e.cq, e.hit, e.i, e.q, e.ver = nil, hit, i, q, e.t.ver
+	return hit && e.ret
+}
+
 // Prev returns the currently enumerated item, if it exists and moves to the
 // previous item in the key collation order. If there is no item to return, err
 // == io.EOF is returned.
@@ -857,10 +3424,15 @@ func (e *Enumerator) Prev() (k interface{} /*K*/, v interface{} /*V*/, err error
 		return
 	}
 
-	if e.ver != e.t.ver {
-		f, _ := e.t.Seek(e.k)
-		*e = *f
-		f.Close()
+	if e.ver != e.t.ver || e.mode == Strict && e.mod != e.t.mod {
+		if e.mode == Strict && e.ver >= 0 {
+			e.err, err = ErrConcurrentModification, ErrConcurrentModification
+			return
+		}
+
+		if e.resync() {
+			e.hit = false
+		}
 	}
 	if e.q == nil {
 		e.err, err = io.EOF, io.EOF
@@ -880,9 +3452,15 @@ func (e *Enumerator) Prev() (k interface{} /*K*/, v interface{} /*V*/, err error
 		}
 	}
 
-	i := e.q.d[e.i]
-	k, v = i.k, i.v
-	e.k, e.hit = k, true
+	k = e.t.key(e.q, e.i)
+	if e.hasLo && e.t.cmp(k, e.lo) < 0 {
+		e.err, err = io.EOF, io.EOF
+		return
+	}
+
+	v = e.q.d[e.i].v
+	e.k, e.hit, e.ret = k, true, true
+	e.cq, e.ci = e.q, e.i
 	e.prev()
 	return
 }
@@ -897,6 +3475,9 @@ func (e *Enumerator) prev() error {
 	case e.i > 0:
 		e.i--
 	default:
+		if e.pver == e.t.ver {
+			e.step(-1)
+		}
 		if e.q = e.q.p; e.q == nil {
 			e.err = io.EOF
 			break
@@ -0,0 +1,292 @@
+// Copyright 2026 The b Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package b
+
+import (
+	"bytes"
+	"strings"
+)
+
+// TreeNewBytes returns a newly created, empty Tree for []byte keys. Keys are
+// collated by bytes.Compare, which the tree calls directly instead of going
+// through a Cmp function value. Trees returned by TreeNewBytes support
+// SeekPrefix.
+//
+// The data pages of the tree are prefix compressed. A page stores the common
+// prefix of its keys once and a copy of the rest of every key, which saves
+// memory for keys sharing long prefixes, like paths or URLs. Keys handed out
+// by the tree, eg. by First, Last or an Enumerator, are newly allocated then.
+func TreeNewBytes() *Tree {
+	t := btTPool.get(Bytes)
+	t.compress, t.fastFind, t.succ = true, findBytes, succBytes
+	return t
+}
+
+// TreeNewString returns a newly created, empty Tree for string keys. It is
+// the string counterpart of TreeNewBytes.
+func TreeNewString() *Tree {
+	t := btTPool.get(Strings)
+	t.compress, t.fastFind, t.succ = true, findString, succString
+	return t
+}
+
+func findBytes(q interface{}, k interface{}) (i int, ok bool) {
+	kb := k.([]byte)
+	l := 0
+	switch x := q.(type) {
+	case *x:
+		h := x.c - 1
+		for l <= h {
+			m := (l + h) >> 1
+			switch cmp := bytes.Compare(kb, x.x[m].k.([]byte)); {
+			case cmp > 0:
+				l = m + 1
+			case cmp == 0:
+				return m, true
+			default:
+				h = m - 1
+			}
+		}
+	case *d:
+		if n := len(x.pfx); len(kb) < n || string(kb[:n]) != x.pfx {
+			if string(kb) > x.pfx {
+				return x.c, false
+			}
+
+			return 0, false
+		}
+
+		kb = kb[len(x.pfx):]
+		h := x.c - 1
+		for l <= h {
+			m := (l + h) >> 1
+			switch cmp := bytes.Compare(kb, x.d[m].k.([]byte)); {
+			case cmp > 0:
+				l = m + 1
+			case cmp == 0:
+				return m, true
+			default:
+				h = m - 1
+			}
+		}
+	}
+	return l, false
+}
+
+func findString(q interface{}, k interface{}) (i int, ok bool) {
+	ks := k.(string)
+	l := 0
+	switch x := q.(type) {
+	case *x:
+		h := x.c - 1
+		for l <= h {
+			m := (l + h) >> 1
+			switch mk := x.x[m].k.(string); {
+			case ks > mk:
+				l = m + 1
+			case ks == mk:
+				return m, true
+			default:
+				h = m - 1
+			}
+		}
+	case *d:
+		if !strings.HasPrefix(ks, x.pfx) {
+			if ks > x.pfx {
+				return x.c, false
+			}
+
+			return 0, false
+		}
+
+		ks = ks[len(x.pfx):]
+		h := x.c - 1
+		for l <= h {
+			m := (l + h) >> 1
+			switch mk := x.d[m].k.(string); {
+			case ks > mk:
+				l = m + 1
+			case ks == mk:
+				return m, true
+			default:
+				h = m - 1
+			}
+		}
+	}
+	return l, false
+}
+
+// succBytes returns the least []byte greater than all keys having prefix p.
+// There's no such key if p is empty or consists of 0xff bytes only.
+func succBytes(p interface{}) (interface{}, bool) {
+	b := p.([]byte)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] != 0xff {
+			s := make([]byte, i+1)
+			copy(s, b)
+			s[i]++
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+func succString(p interface{}) (interface{}, bool) {
+	s, ok := succBytes([]byte(p.(string)))
+	if !ok {
+		return nil, false
+	}
+
+	return string(s.([]byte)), true
+}
+
+// key returns the key of the item i of q.
+func (t *Tree) key(q *d, i int) interface{} /*K*/ {
+	if !t.compress {
+		return q.d[i].k
+	}
+
+	return join(q.pfx, q.d[i].k)
+}
+
+// encode prefix compresses the items [lo, hi) of q, whose keys are the rest of
+// keys having the prefix p. The other items of q are compressed already. The
+// prefix of q shrinks to the common prefix of all its keys.
+func (t *Tree) encode(q *d, lo, hi int, p string) {
+	if !t.compress || lo == hi {
+		return
+	}
+
+	if hi-lo == q.c {
+		q.pfx = p + prefix(q.d[lo].k, common(q.d[lo].k, q.d[hi-1].k))
+	}
+	n := common(q.pfx, p)
+	if n == len(p) {
+		m := len(q.pfx) - n
+		for _, it := range q.d[lo:hi] {
+			m = common(q.pfx[n:n+m], it.k)
+		}
+		n += m
+	}
+	if s := q.pfx[n:]; s != "" {
+		for i := range q.d[:q.c] {
+			if i < lo || i >= hi {
+				q.d[i].k = join(s, q.d[i].k)
+			}
+		}
+		q.pfx = q.pfx[:n]
+	}
+	for i := lo; i < hi; i++ {
+		switch {
+		case n < len(p):
+			q.d[i].k = join(p[n:], q.d[i].k)
+		case n > len(p):
+			q.d[i].k = suffix(q.d[i].k, n-len(p))
+		}
+	}
+}
+
+// pack extends the prefix of q by the common prefix of the suffixes of its
+// keys.
+func (t *Tree) pack(q *d) {
+	if !t.compress || q.c == 0 {
+		return
+	}
+
+	n := common(q.d[0].k, q.d[q.c-1].k)
+	if n == 0 {
+		return
+	}
+
+	q.pfx += prefix(q.d[0].k, n)
+	for i := range q.d[:q.c] {
+		q.d[i].k = suffix(q.d[i].k, n)
+	}
+}
+
+// mvL moves c items from r to l.
+func (t *Tree) mvL(l, r *d, c int) {
+	l.mvL(r, c)
+	t.encode(l, l.c-c, l.c, r.pfx)
+}
+
+// mvR moves c items from l to r.
+func (t *Tree) mvR(l, r *d, c int) {
+	l.mvR(r, c)
+	t.encode(r, 0, c, l.pfx)
+}
+
+// join returns the key having the prefix p and the suffix s.
+func join(p string, s interface{} /*K*/) interface{} /*K*/ {
+	if p == "" {
+		return s
+	}
+
+	switch s := s.(type) {
+	case []byte:
+		b := make([]byte, len(p)+len(s))
+		copy(b[copy(b, p):], s)
+		return b
+	default:
+		return p + s.(string)
+	}
+}
+
+// common returns the length of the common prefix of a and b, which are
+// strings or []byte.
+func common(a, b interface{}) (n int) {
+	switch a := a.(type) {
+	case []byte:
+		switch b := b.(type) {
+		case []byte:
+			for n < len(a) && n < len(b) && a[n] == b[n] {
+				n++
+			}
+		case string:
+			for n < len(a) && n < len(b) && a[n] == b[n] {
+				n++
+			}
+		}
+	case string:
+		switch b := b.(type) {
+		case []byte:
+			for n < len(a) && n < len(b) && a[n] == b[n] {
+				n++
+			}
+		case string:
+			for n < len(a) && n < len(b) && a[n] == b[n] {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// prefix returns a copy of the first n bytes of k.
+func prefix(k interface{} /*K*/, n int) string {
+	switch k := k.(type) {
+	case []byte:
+		return string(k[:n])
+	default:
+		return cloneString(k.(string)[:n])
+	}
+}
+
+// suffix returns a copy of k without its first n bytes.
+func suffix(k interface{} /*K*/, n int) interface{} /*K*/ {
+	switch k := k.(type) {
+	case []byte:
+		return append([]byte{}, k[n:]...)
+	default:
+		return cloneString(k.(string)[n:])
+	}
+}
+
+// cloneString returns a copy of s not sharing its memory.
+func cloneString(s string) string {
+	var b strings.Builder
+	b.WriteString(s)
+	return b.String()
+}
@@ -0,0 +1,169 @@
+// Copyright 2026 The b Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package b
+
+import (
+	"bytes"
+	"reflect"
+	"time"
+)
+
+// Bytes is a Cmp of []byte keys, it collates them like bytes.Compare. A nil
+// key is equal to an empty one.
+func Bytes(a, b interface{}) int { return bytes.Compare(a.([]byte), b.([]byte)) }
+
+// Ints is a Cmp of int keys.
+func Ints(a, b interface{}) int {
+	switch a, b := a.(int), b.(int); {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Strings is a Cmp of string keys.
+func Strings(a, b interface{}) int {
+	switch a, b := a.(string), b.(string); {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Time is a Cmp of time.Time keys. Keys denoting the same instant are equal,
+// regardless of their locations.
+func Time(a, b interface{}) int {
+	switch a, b := a.(time.Time), b.(time.Time); {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// NilsFirst returns a Cmp collating nil keys before all other keys, which are
+// collated by c. c is never passed a nil key.
+func NilsFirst(c Cmp) Cmp { return nils(c, -1) }
+
+// NilsLast returns a Cmp collating nil keys after all other keys, which are
+// collated by c. c is never passed a nil key.
+func NilsLast(c Cmp) Cmp { return nils(c, 1) }
+
+func nils(c Cmp, r int) Cmp {
+	return func(a, b interface{}) int {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return r
+		case b == nil:
+			return -r
+		default:
+			return c(a, b)
+		}
+	}
+}
+
+// Reverse returns a Cmp collating keys in the order reverse to c.
+func Reverse(c Cmp) Cmp {
+	return func(a, b interface{}) int { return c(b, a) }
+}
+
+// Tuple returns a Cmp of composite keys: []interface{} values, other slices
+// or arrays, or structs having only exported fields. The keys are compared
+// element by element, or field by field, the i-th one by c[i], until they
+// differ. Only the first len(c) elements are compared. A key having less
+// elements collates before a longer key having the same leading elements.
+//
+//	t := TreeNew(Tuple(Strings, Reverse(Ints)))
+//	t.Set([]interface{}{"b", 1}, v)
+//	t.Set([]interface{}{"a", 1}, v)
+//	t.Set([]interface{}{"a", 2}, v) // Collates before {"a", 1}.
+//
+// Keys of a type other than []interface{} are accessed by reflection, which
+// makes their comparison slower.
+func Tuple(c ...Cmp) Cmp {
+	c = append([]Cmp(nil), c...)
+	return func(a, b interface{}) int {
+		x, okx := a.([]interface{})
+		y, oky := b.([]interface{})
+		if okx && oky {
+			n := len(x)
+			if len(y) < n {
+				n = len(y)
+			}
+			if len(c) < n {
+				n = len(c)
+			}
+			for i, c := range c[:n] {
+				if r := c(x[i], y[i]); r != 0 {
+					return r
+				}
+			}
+
+			return tupleLen(len(x), len(y), len(c))
+		}
+
+		va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+		la, lb := tupleElems(va), tupleElems(vb)
+		n := la
+		if lb < n {
+			n = lb
+		}
+		if len(c) < n {
+			n = len(c)
+		}
+		for i, c := range c[:n] {
+			if r := c(tupleElem(va, i), tupleElem(vb, i)); r != 0 {
+				return r
+			}
+		}
+
+		return tupleLen(la, lb, len(c))
+	}
+}
+
+// tupleLen collates tuples of la and lb elements having the same first n
+// elements, n being the least of la, lb and m.
+func tupleLen(la, lb, m int) int {
+	if la > m {
+		la = m
+	}
+	if lb > m {
+		lb = m
+	}
+	switch {
+	case la < lb:
+		return -1
+	case la > lb:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func tupleElems(v reflect.Value) int {
+	if v.Kind() == reflect.Struct {
+		return v.NumField()
+	}
+
+	return v.Len()
+}
+
+func tupleElem(v reflect.Value, i int) interface{} {
+	if v.Kind() == reflect.Struct {
+		return v.Field(i).Interface()
+	}
+
+	return v.Index(i).Interface()
+}
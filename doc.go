@@ -6,6 +6,23 @@
 //
 // Changelog
 //
+// 2026-10-18: Add TreeNewBytes, TreeNewString and Tree.SeekPrefix. Add
+// TreeNewOptions, Options.PrefixSuccessor and Tree.ScanPrefix. Add augmented
+// trees, see Monoid, Tree.Aggregate and Tree.AggregateAll. Add IntervalTree.
+// Add Tree.{Ceiling,Floor,Higher,Lower}. Add
+// Tree.{PopFirst,PopFirstN,PopLast}. Add Enumerator.{Delete,SetValue}. Fix
+// Enumerator.{Next,Prev} returning the last item again after the tree was
+// mutated. Add Enumerator.SetMode. Add Cursor. Add Tree.Partitions. Add
+// Tree.BuildParallel. Add Tree.Clone. Add Tree.{Diff,DiffFunc,Equal}. Add
+// Options.Hasher and Tree.{RangeHash,RootHash}. Add Observer, Tree.SetObserver
+// and ChanObserver. Add ExpiringTree. Add Options.{Evict,MaxItems,OnEvict}.
+// Add Options.{MaxBytes,Sizer} and Tree.Bytes. Add
+// Tree.{CompareAndDelete,CompareAndSwap,DeleteIf,SetIfAbsent}. Add
+// Tree.DeleteFunc. Add Tree.ApplySorted. Add Enumerator.SeekFrom. Add
+// Tree.EstimateRange and Monoid.Count. Add Tree.{RandomItem,Sample} and
+// Options.Seed. Add Bytes, Ints, NilsFirst, NilsLast, Reverse, Strings, Time
+// and Tuple.
+//
 // 2016-07-16: Update benchmark results to newer Go version. Add a note on
 // concurrency.
 //
@@ -15,20 +32,38 @@
 //
 // Concurrency considerations
 //
-// Tree.{Clear,Delete,Put,Set} mutate the tree. One can use eg. a
-// sync.Mutex.Lock/Unlock (or sync.RWMutex.Lock/Unlock) to wrap those calls if
-// they are to be invoked concurrently.
+// Tree.{ApplySorted,BuildParallel,Clear,CompareAndDelete,CompareAndSwap,
+// Delete,DeleteFunc,DeleteIf,PopFirst,PopFirstN,PopLast,Put,Set,SetIfAbsent,
+// SetObserver} mutate the tree. One can use eg. a sync.Mutex.Lock/Unlock (or
+// sync.RWMutex.Lock/Unlock) to wrap those calls if they are to be invoked
+// concurrently.
+//
+// Tree.{Aggregate,AggregateAll,Bytes,Ceiling,Clone,Diff,DiffFunc,Equal,
+// EstimateRange,First,Floor,Get,Higher,Last,Len,Lower,Partitions,RandomItem,
+// RangeHash,RootHash,Sample,ScanPrefix,Seek,SeekFirst,SeekLast,SeekPrefix}
+// read but do not mutate the tree. One can use eg. a
+// sync.RWMutex.RLock/RUnlock to wrap those calls if they are to be invoked
+// concurrently with any of the tree mutating methods.
+//
+// Get of a tree using the EvictLRU policy mutates the tree.
+//
+// Enumerator.{Next,Prev,SeekFrom} mutate the enumerator and read but not
+// mutate the tree. One can use eg. a sync.RWMutex.RLock/RUnlock to wrap those
+// calls if they are to be invoked concurrently with any of the tree mutating
+// methods. A separate mutex for the enumerator, or the whole tree in a
+// simplified variant, is necessary if the enumerator's Next/Prev methods per
+// se are to be invoked concurrently.
+//
+// Enumerator.{Delete,SetValue} mutate the tree like the Tree mutating methods
+// do.
+//
+// An Observer is called synchronously by the method mutating the tree, while
+// the lock wrapping the call, if any, is held.
 //
-// Tree.{First,Get,Last,Len,Seek,SeekFirst,SekLast} read but do not mutate the
-// tree.  One can use eg. a sync.RWMutex.RLock/RUnlock to wrap those calls if
-// they are to be invoked concurrently with any of the tree mutating methods.
+// ExpiringTree methods are safe for concurrent use.
 //
-// Enumerator.{Next,Prev} mutate the enumerator and read but not mutate the
-// tree.  One can use eg. a sync.RWMutex.RLock/RUnlock to wrap those calls if
-// they are to be invoked concurrently with any of the tree mutating methods. A
-// separate mutex for the enumerator, or the whole tree in a simplified
-// variant, is necessary if the enumerator's Next/Prev methods per se are to
-// be invoked concurrently.
+// Cursor methods, except Close and SetMode, read but do not mutate the tree,
+// the same considerations as for Enumerator.{Next,Prev} apply to them.
 //
 // Generic types
 //
@@ -0,0 +1,227 @@
+// Copyright 2026 The b Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package b
+
+import (
+	"io"
+)
+
+type (
+	// Interval is the half-open range [Lo, Hi) of keys collated by the
+	// Cmp of the IntervalTree it's used with. Intervals with Lo >= Hi are
+	// empty, they can be stored but they overlap nothing.
+	Interval struct {
+		Lo, Hi interface{}
+	}
+
+	// IntervalTree is a B+tree of intervals keyed by the interval start.
+	// Every page of the tree keeps the maximum end of its intervals, which
+	// enables finding the intervals overlapping a point or a range in
+	// O(log n + m), where m is the number of the found intervals.
+	IntervalTree struct {
+		cmp Cmp
+		t   *Tree
+	}
+
+	// IntervalEnumerator captures the state of enumerating the intervals
+	// found by IntervalTree.Overlapping or IntervalTree.Stabbing, in the
+	// order of their starts. Like Enumerator, it resumes after the last
+	// returned interval if the tree was mutated in the process.
+	IntervalEnumerator struct {
+		err   error
+		hi    interface{} // query end, or the stabbing point if incl
+		i     int
+		incl  bool
+		last  Interval
+		lo    interface{}
+		q     *d
+		seen  bool // last is valid
+		stack []ipos
+		t     *IntervalTree
+		ver   int64
+	}
+
+	ipos struct {
+		x *x
+		i int
+	}
+)
+
+// IntervalTreeNew returns a newly created, empty IntervalTree. The compare
+// function is used for collating the interval bounds.
+func IntervalTreeNew(cmp Cmp) *IntervalTree {
+	it := &IntervalTree{cmp: cmp}
+	it.t = TreeNewOptions(
+		func(a, b interface{}) int {
+			x, y := a.(Interval), b.(Interval)
+			if c := cmp(x.Lo, y.Lo); c != 0 {
+				return c
+			}
+
+			return cmp(x.Hi, y.Hi)
+		},
+		&Options{Monoid: &Monoid{
+			FromItem: func(k, v interface{}) interface{} { return k.(Interval).Hi },
+			Combine: func(a, b interface{}) interface{} {
+				switch {
+				case a == nil:
+					return b
+				case b == nil || cmp(a, b) >= 0:
+					return a
+				default:
+					return b
+				}
+			},
+		}},
+	)
+	return it
+}
+
+// Clear removes all intervals from the tree.
+func (t *IntervalTree) Clear() { t.t.Clear() }
+
+// Close performs Clear and releases the underlying Tree. No references to t
+// should exist or such references must not be used afterwards.
+func (t *IntervalTree) Close() {
+	t.t.Close()
+	*t = IntervalTree{}
+}
+
+// Delete removes the interval iv, if it exists, in which case Delete returns
+// true.
+func (t *IntervalTree) Delete(iv Interval) bool { return t.t.Delete(iv) }
+
+// Get returns the value associated with the interval iv and true if it
+// exists. Otherwise Get returns (nil, false).
+func (t *IntervalTree) Get(iv Interval) (v interface{}, ok bool) { return t.t.Get(iv) }
+
+// Len returns the number of intervals in the tree.
+func (t *IntervalTree) Len() int { return t.t.Len() }
+
+// Set sets the value associated with the interval iv.
+func (t *IntervalTree) Set(iv Interval, v interface{}) { t.t.Set(iv, v) }
+
+// Overlapping returns an enumerator of the intervals overlapping [lo, hi).
+// If lo >= hi, the range is empty and it overlaps nothing.
+func (t *IntervalTree) Overlapping(lo, hi interface{}) *IntervalEnumerator {
+	if t.cmp(lo, hi) >= 0 {
+		return &IntervalEnumerator{err: io.EOF, t: t}
+	}
+
+	return &IntervalEnumerator{hi: hi, lo: lo, t: t, ver: t.t.ver - 1}
+}
+
+// Stabbing returns an enumerator of the intervals containing p.
+func (t *IntervalTree) Stabbing(p interface{}) *IntervalEnumerator {
+	return &IntervalEnumerator{hi: p, incl: true, lo: p, t: t, ver: t.t.ver - 1}
+}
+
+// Next returns the next found interval and its associated value. If there is
+// no interval to return, err == io.EOF is returned.
+func (e *IntervalEnumerator) Next() (iv Interval, v interface{}, err error) {
+	if err = e.err; err != nil {
+		return
+	}
+
+	if e.ver != e.t.t.ver {
+		e.seek()
+	}
+	for {
+		for ; e.q != nil && e.i < e.q.c; e.i++ {
+			it := &e.q.d[e.i]
+			k := it.k.(Interval)
+			if !e.starts(k.Lo) {
+				e.err, err = io.EOF, io.EOF
+				return
+			}
+
+			if e.t.cmp(k.Hi, e.lo) > 0 && e.t.cmp(k.Lo, k.Hi) < 0 {
+				e.i++
+				e.last, e.seen = k, true
+				return k, it.v, nil
+			}
+		}
+
+		if !e.advance() {
+			e.err, err = io.EOF, io.EOF
+			return
+		}
+	}
+}
+
+// starts reports whether an interval starting at lo can be found by e.
+func (e *IntervalEnumerator) starts(lo interface{}) bool {
+	c := e.t.cmp(lo, e.hi)
+	return c < 0 || c == 0 && e.incl
+}
+
+// ends reports whether the page q has an interval ending after e.lo.
+func (e *IntervalEnumerator) ends(q interface{}) bool {
+	a := aggregate(q)
+	return a != nil && e.t.cmp(a, e.lo) > 0
+}
+
+// seek positions e on the first interval after the last returned one.
+func (e *IntervalEnumerator) seek() {
+	t := e.t.t
+	e.q, e.stack, e.ver = nil, e.stack[:0], t.ver
+	q := t.r
+	if q == nil || !e.ends(q) {
+		return
+	}
+
+	for {
+		switch x := q.(type) {
+		case *x:
+			i := 0
+			if e.seen {
+				i = t.child(x, e.last)
+			}
+			e.stack = append(e.stack, ipos{x, i})
+			if q = x.x[i].ch; !e.ends(q) {
+				return
+			}
+		case *d:
+			e.q, e.i = x, 0
+			if e.seen {
+				var ok bool
+				if e.i, ok = t.find(x, e.last); ok {
+					e.i++
+				}
+			}
+			return
+		}
+	}
+}
+
+// advance moves e to the next leaf page which may contain overlapping
+// intervals. It returns false if there's no such page.
+func (e *IntervalEnumerator) advance() bool {
+	e.q = nil
+	for n := len(e.stack); n != 0; n = len(e.stack) {
+		p := &e.stack[n-1]
+		if p.i++; p.i > p.x.c {
+			e.stack = e.stack[:n-1]
+			continue
+		}
+
+		if p.i > 0 && !e.starts(p.x.x[p.i-1].k.(Interval).Lo) {
+			return false
+		}
+
+		switch x := p.x.x[p.i].ch.(type) {
+		case *x:
+			if e.ends(x) {
+				e.stack = append(e.stack, ipos{x, -1})
+			}
+		case *d:
+			if e.ends(x) {
+				e.q, e.i = x, 0
+				return true
+			}
+		}
+	}
+	return false
+}
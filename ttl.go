@@ -0,0 +1,334 @@
+// Copyright 2026 The b Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package b
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	// Clock tells the current time to an ExpiringTree.
+	Clock interface {
+		Now() time.Time
+	}
+
+	// ExpiringTree is a B+tree of items which may expire. Expired items
+	// are hidden from Get, Seek* and the enumerators. Get removes the
+	// expired item it finds, all of the expired items are removed by
+	// Sweep, which can be called periodically by a goroutine started by
+	// SweepEvery. A second tree, ordered by the expiration times, makes
+	// Sweep O(m log n), where m is the number of the expired items.
+	//
+	// ExpiringTree methods are safe for concurrent use, a single
+	// ExpiringEnumerator is not.
+	ExpiringTree struct {
+		clock Clock
+		exp   *Tree // expKey -> nil
+		mu    sync.Mutex
+		stop  chan struct{}
+		t     *Tree // k -> expEntry
+	}
+
+	// ExpiringEnumerator captures the state of enumerating an
+	// ExpiringTree. It skips the expired items and otherwise behaves like
+	// Enumerator.
+	ExpiringEnumerator struct {
+		e *Enumerator
+		t *ExpiringTree
+	}
+
+	expEntry struct {
+		exp int64 // UnixNano, 0: never expires
+		v   interface{}
+	}
+
+	expKey struct {
+		exp int64
+		k   interface{}
+	}
+
+	systemClock struct{}
+)
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// ExpiringTreeNew returns a newly created, empty ExpiringTree. The compare
+// function is used for key collation. If clock is nil, the system clock is
+// used.
+func ExpiringTreeNew(cmp Cmp, clock Clock) *ExpiringTree {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &ExpiringTree{
+		clock: clock,
+		exp: TreeNew(func(a, b interface{}) int {
+			x, y := a.(expKey), b.(expKey)
+			switch {
+			case x.exp < y.exp:
+				return -1
+			case x.exp > y.exp:
+				return 1
+			default:
+				return cmp(x.k, y.k)
+			}
+		}),
+		t: TreeNew(cmp),
+	}
+}
+
+// Clear removes all items from the tree.
+func (t *ExpiringTree) Clear() {
+	t.mu.Lock()
+	t.t.Clear()
+	t.exp.Clear()
+	t.mu.Unlock()
+}
+
+// Close stops the goroutine started by SweepEvery, if any, performs Clear and
+// releases the underlying trees. No references to t should exist or such
+// references must not be used afterwards.
+func (t *ExpiringTree) Close() {
+	t.SweepEvery(0)
+	t.mu.Lock()
+	t.t.Close()
+	t.exp.Close()
+	t.t, t.exp = nil, nil // A pending Sweep must not touch the recycled trees.
+	t.mu.Unlock()
+}
+
+// Delete removes the k's item, if it exists. Delete returns true if the item
+// existed and was not expired.
+func (t *ExpiringTree) Delete(k interface{}) (ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	v, ok := t.t.Get(k)
+	if !ok {
+		return false
+	}
+
+	t.delete(k, v.(expEntry))
+	return !t.expired(v.(expEntry), t.now())
+}
+
+func (t *ExpiringTree) delete(k interface{}, e expEntry) {
+	t.t.Delete(k)
+	if e.exp != 0 {
+		t.exp.Delete(expKey{e.exp, k})
+	}
+}
+
+func (t *ExpiringTree) expired(e expEntry, now int64) bool {
+	return e.exp != 0 && e.exp <= now
+}
+
+// Get returns the value associated with k and true if it exists and it's not
+// expired. Otherwise Get returns (nil, false).
+func (t *ExpiringTree) Get(k interface{}) (v interface{}, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if v, ok = t.t.Get(k); !ok {
+		return nil, false
+	}
+
+	e := v.(expEntry)
+	if t.expired(e, t.now()) {
+		t.delete(k, e)
+		return nil, false
+	}
+
+	return e.v, true
+}
+
+// Len returns the number of items in the tree, including the expired items
+// not yet removed by Get or Sweep.
+func (t *ExpiringTree) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.t.Len()
+}
+
+func (t *ExpiringTree) now() int64 { return t.clock.Now().UnixNano() }
+
+// Seek returns an ExpiringEnumerator positioned on an item such that k >=
+// item's key. ok reports if k == item's key and the item is not expired.
+func (t *ExpiringTree) Seek(k interface{}) (e *ExpiringEnumerator, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	en, ok := t.t.Seek(k)
+	if ok {
+		v, _ := t.t.Get(k)
+		ok = !t.expired(v.(expEntry), t.now())
+	}
+	return &ExpiringEnumerator{en, t}, ok
+}
+
+// SeekFirst returns an ExpiringEnumerator positioned on the first item in the
+// tree, if any. For an empty tree, err == io.EOF is returned and e will be
+// nil.
+func (t *ExpiringTree) SeekFirst() (e *ExpiringEnumerator, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	en, err := t.t.SeekFirst()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExpiringEnumerator{en, t}, nil
+}
+
+// SeekLast returns an ExpiringEnumerator positioned on the last item in the
+// tree, if any. For an empty tree, err == io.EOF is returned and e will be
+// nil.
+func (t *ExpiringTree) SeekLast() (e *ExpiringEnumerator, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	en, err := t.t.SeekLast()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExpiringEnumerator{en, t}, nil
+}
+
+// Set sets the value associated with k. The item never expires.
+func (t *ExpiringTree) Set(k, v interface{}) {
+	t.mu.Lock()
+	t.set(k, v, 0)
+	t.mu.Unlock()
+}
+
+// SetWithTTL sets the value associated with k. The item expires after d. If d
+// <= 0, the item is removed.
+func (t *ExpiringTree) SetWithTTL(k, v interface{}, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if d <= 0 {
+		if v, ok := t.t.Get(k); ok {
+			t.delete(k, v.(expEntry))
+		}
+		return
+	}
+
+	t.set(k, v, t.clock.Now().Add(d).UnixNano())
+}
+
+func (t *ExpiringTree) set(k, v interface{}, exp int64) {
+	var old int64
+	t.t.Put(k, func(o interface{}, ok bool) (interface{}, bool) {
+		if ok {
+			old = o.(expEntry).exp
+		}
+		return expEntry{exp, v}, true
+	})
+	if old == exp {
+		return
+	}
+
+	if old != 0 {
+		t.exp.Delete(expKey{old, k})
+	}
+	if exp != 0 {
+		t.exp.Set(expKey{exp, k}, nil)
+	}
+}
+
+// Sweep removes the expired items and returns their number.
+func (t *ExpiringTree) Sweep() (n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.t == nil { // closed
+		return 0
+	}
+
+	now := t.now()
+	for {
+		k, _ := t.exp.First()
+		if k == nil || k.(expKey).exp > now {
+			return n
+		}
+
+		t.exp.PopFirst()
+		t.t.Delete(k.(expKey).k)
+		n++
+	}
+}
+
+// SweepEvery starts a goroutine calling Sweep every d. The goroutine started
+// by a previous call of SweepEvery, if any, is stopped. If d <= 0, no new
+// goroutine is started.
+func (t *ExpiringTree) SweepEvery(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stop != nil {
+		close(t.stop)
+		t.stop = nil
+	}
+	if d <= 0 {
+		return
+	}
+
+	stop := make(chan struct{})
+	t.stop = stop
+	go func() {
+		tick := time.NewTicker(d)
+		defer tick.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tick.C:
+				t.Sweep()
+			}
+		}
+	}()
+}
+
+// Close recycles the underlying Enumerator. e must not be used afterwards.
+func (e *ExpiringEnumerator) Close() {
+	e.t.mu.Lock()
+	e.e.Close()
+	e.t.mu.Unlock()
+}
+
+// Next returns the currently enumerated item which is not expired, if it
+// exists, and moves to the next one in the key collation order. If there is
+// no item to return, err == io.EOF is returned.
+func (e *ExpiringEnumerator) Next() (k, v interface{}, err error) {
+	return e.step(e.e.Next)
+}
+
+// Prev returns the currently enumerated item which is not expired, if it
+// exists, and moves to the previous one in the key collation order. If there
+// is no item to return, err == io.EOF is returned.
+func (e *ExpiringEnumerator) Prev() (k, v interface{}, err error) {
+	return e.step(e.e.Prev)
+}
+
+func (e *ExpiringEnumerator) step(f func() (interface{}, interface{}, error)) (k, v interface{}, err error) {
+	t := e.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	for {
+		if k, v, err = f(); err != nil {
+			return nil, nil, err
+		}
+
+		if x := v.(expEntry); !t.expired(x, now) {
+			return k, x.v, nil
+		}
+	}
+}